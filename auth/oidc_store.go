@@ -0,0 +1,287 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrInvalidState = errors.New("invalid or expired login state")
+	// ErrUnverifiedEmail означава, че имейлът от доставчика принадлежи на акаунт,
+	// чийто имейл още не е потвърден - не го свързваме и не създаваме дубликат
+	ErrUnverifiedEmail = errors.New("an account with this email exists; verify its email before signing in with the identity provider")
+	ErrNotFound        = errors.New("not found")
+)
+
+// OIDCLoginState е записаното при започване на входа. StateHash е хешът на state.
+type OIDCLoginState struct {
+	StateHash    string
+	CodeVerifier string
+	Nonce        string
+	ExpiresAt    time.Time
+}
+
+// OIDCStateStore пази състоянията на започнатите входове. Всяко състояние е еднократно.
+type OIDCStateStore interface {
+	Save(state OIDCLoginState) error
+	// Take връща и изтрива състоянието. Липсващо, вече използвано или изтекло - ErrInvalidState.
+	Take(stateHash string, now time.Time) (*OIDCLoginState, error)
+}
+
+// MySQLStateStore пази състоянията в таблицата oidc_states.
+type MySQLStateStore struct {
+	db *sql.DB
+}
+
+func NewMySQLStateStore(db *sql.DB) *MySQLStateStore {
+	return &MySQLStateStore{db: db}
+}
+
+func (s *MySQLStateStore) Save(state OIDCLoginState) error {
+	_, err := s.db.Exec(`
+        INSERT INTO oidc_states (state_hash, code_verifier, nonce, expires_at)
+        VALUES (?, ?, ?, ?)`,
+		state.StateHash, state.CodeVerifier, state.Nonce, state.ExpiresAt)
+	return err
+}
+
+func (s *MySQLStateStore) Take(stateHash string, now time.Time) (*OIDCLoginState, error) {
+	state := OIDCLoginState{StateHash: stateHash}
+	var id int
+	err := s.db.QueryRow(`
+        SELECT id, code_verifier, nonce, expires_at
+        FROM oidc_states
+        WHERE state_hash = ?`, stateHash).Scan(&id, &state.CodeVerifier, &state.Nonce, &state.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidState
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Само заявката, която реално изтрие реда, може да използва състоянието
+	result, err := s.db.Exec("DELETE FROM oidc_states WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 || now.After(state.ExpiresAt) {
+		return nil, ErrInvalidState
+	}
+	return &state, nil
+}
+
+// MemoryStateStore пази състоянията в паметта на процеса. Подходящ е при една инстанция и в тестове.
+type MemoryStateStore struct {
+	mu     sync.Mutex
+	states map[string]OIDCLoginState
+}
+
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{states: make(map[string]OIDCLoginState)}
+}
+
+func (s *MemoryStateStore) Save(state OIDCLoginState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.states[state.StateHash] = state
+	return nil
+}
+
+func (s *MemoryStateStore) Take(stateHash string, now time.Time) (*OIDCLoginState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.states[stateHash]
+	if !ok {
+		return nil, ErrInvalidState
+	}
+	delete(s.states, stateHash)
+	if now.After(state.ExpiresAt) {
+		return nil, ErrInvalidState
+	}
+	return &state, nil
+}
+
+// OIDCAccounts намира и създава локалните акаунти за външните идентичности.
+type OIDCAccounts interface {
+	// FindIdentity връща потребителя, свързан с идентичността, или ErrNotFound
+	FindIdentity(provider, subject string) (int, error)
+	// FindUserByEmail връща акаунта с този имейл и дали имейлът е потвърден, или ErrNotFound
+	FindUserByEmail(email string) (userID int, verified bool, err error)
+	LinkIdentity(userID int, provider, subject, email string) error
+	// CreateUserWithIdentity създава акаунт и идентичността му атомарно.
+	// При зает username връща ErrUsernameTaken.
+	CreateUserWithIdentity(username, email, provider, subject, identityEmail string) (int, error)
+}
+
+var ErrUsernameTaken = errors.New("username is taken")
+
+// ResolveOIDCUser намира потребителя за външната идентичност. Ако няма връзка,
+// свързва идентичността с акаунт с потвърден същия имейл или създава нов акаунт.
+// Имейлът от доставчика се използва само ако доставчикът го е потвърдил.
+func ResolveOIDCUser(accounts OIDCAccounts, provider string, claims *OIDCClaims, validEmail func(string) bool) (int, error) {
+	userID, err := accounts.FindIdentity(provider, claims.Subject)
+	if err == nil {
+		return userID, nil
+	}
+	if err != ErrNotFound {
+		return 0, err
+	}
+
+	email := ""
+	if bool(claims.EmailVerified) && validEmail(claims.Email) {
+		email = claims.Email
+	}
+
+	if email != "" {
+		userID, verified, err := accounts.FindUserByEmail(email)
+		switch {
+		case err == nil && verified:
+			if err := accounts.LinkIdentity(userID, provider, claims.Subject, claims.Email); err != nil {
+				return 0, err
+			}
+			return userID, nil
+		case err == nil:
+			return 0, ErrUnverifiedEmail
+		case err != ErrNotFound:
+			return 0, err
+		}
+	}
+
+	base := oidcUsernameBase(claims)
+	for attempt := 0; attempt < 5; attempt++ {
+		username := base
+		if attempt > 0 {
+			suffix, _, err := NewOpaqueToken()
+			if err != nil {
+				return 0, err
+			}
+			username = base + "-" + strings.ToLower(suffix[:6])
+		}
+
+		userID, err := accounts.CreateUserWithIdentity(username, email, provider, claims.Subject, claims.Email)
+		if err == ErrUsernameTaken {
+			continue
+		}
+		return userID, err
+	}
+	return 0, fmt.Errorf("could not find a free username for %q", base)
+}
+
+// oidcUsernameBase прави username от preferred_username или имейла на доставчика
+func oidcUsernameBase(claims *OIDCClaims) string {
+	base := claims.PreferredUsername
+	if base == "" && claims.Email != "" {
+		base = strings.SplitN(claims.Email, "@", 2)[0]
+	}
+	base = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-' {
+			return r
+		}
+		return -1
+	}, base)
+	if base == "" {
+		base = "user"
+	}
+	if len(base) > 40 {
+		base = base[:40]
+	}
+	return base
+}
+
+// MySQLOIDCAccounts работи с таблиците users и user_identities.
+type MySQLOIDCAccounts struct {
+	db *sql.DB
+}
+
+func NewMySQLOIDCAccounts(db *sql.DB) *MySQLOIDCAccounts {
+	return &MySQLOIDCAccounts{db: db}
+}
+
+func (a *MySQLOIDCAccounts) FindIdentity(provider, subject string) (int, error) {
+	var userID int
+	err := a.db.QueryRow(`
+        SELECT user_id FROM user_identities
+        WHERE provider = ? AND subject = ?`, provider, subject).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	}
+	return userID, err
+}
+
+func (a *MySQLOIDCAccounts) FindUserByEmail(email string) (int, bool, error) {
+	var userID int
+	var verified bool
+	err := a.db.QueryRow(`
+        SELECT id, email_verified_at IS NOT NULL FROM users
+        WHERE email = ?`, email).Scan(&userID, &verified)
+	if err == sql.ErrNoRows {
+		return 0, false, ErrNotFound
+	}
+	return userID, verified, err
+}
+
+func (a *MySQLOIDCAccounts) LinkIdentity(userID int, provider, subject, email string) error {
+	_, err := a.db.Exec(`
+        INSERT INTO user_identities (user_id, provider, subject, email)
+        VALUES (?, ?, ?, NULLIF(?, ''))`,
+		userID, provider, subject, email)
+	return err
+}
+
+func (a *MySQLOIDCAccounts) CreateUserWithIdentity(username, email, provider, subject, identityEmail string) (int, error) {
+	// Паролата е случайна - потребителят влиза през доставчика или я сменя чрез reset
+	randomPassword, _, err := NewOpaqueToken()
+	if err != nil {
+		return 0, err
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(randomPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)", username).Scan(&exists); err != nil {
+		return 0, err
+	}
+	if exists {
+		return 0, ErrUsernameTaken
+	}
+
+	result, err := tx.Exec(`
+        INSERT INTO users (username, password, height, email, email_verified_at)
+        VALUES (?, ?, 0, NULLIF(?, ''), IF(? = '', NULL, CURRENT_TIMESTAMP))`,
+		username, string(hashedPassword), email, email)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(`
+        INSERT INTO user_identities (user_id, provider, subject, email)
+        VALUES (?, ?, ?, NULLIF(?, ''))`,
+		id, provider, subject, identityEmail)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return int(id), nil
+}
@@ -0,0 +1,367 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testIdP е локален доставчик на идентичност: discovery, JWKS и token endpoint.
+// Кодовете се издават с authorize, както след успешен вход при доставчика.
+type testIdP struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]issuedCode
+}
+
+type issuedCode struct {
+	challenge string
+	nonce     string
+	claims    map[string]interface{}
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &testIdP{t: t, key: key, codes: make(map[string]issuedCode)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test-key",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", idp.token)
+
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// authorize издава код за параметрите от адреса за вход
+func (idp *testIdP) authorize(authURL string, claims map[string]interface{}) string {
+	idp.t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		idp.t.Fatalf("authorization request without S256 PKCE: %s", authURL)
+	}
+
+	code, _, err := NewOpaqueToken()
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	idp.mu.Lock()
+	idp.codes[code] = issuedCode{challenge: q.Get("code_challenge"), nonce: q.Get("nonce"), claims: claims}
+	idp.mu.Unlock()
+	return code
+}
+
+func (idp *testIdP) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+
+	idp.mu.Lock()
+	issued, ok := idp.codes[r.PostForm.Get("code")]
+	delete(idp.codes, r.PostForm.Get("code"))
+	idp.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != issued.challenge {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	claims := map[string]interface{}{
+		"iss":   idp.server.URL,
+		"aud":   "test-client",
+		"sub":   "subject-1",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": issued.nonce,
+	}
+	for k, v := range issued.claims {
+		claims[k] = v
+	}
+	json.NewEncoder(w).Encode(map[string]string{"id_token": idp.sign(claims)})
+}
+
+func (idp *testIdP) sign(claims map[string]interface{}) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"test-key"}`))
+	payload, _ := json.Marshal(claims)
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func newTestProvider(t *testing.T, idp *testIdP) *OIDCProvider {
+	t.Helper()
+	provider, err := NewOIDCProvider(OIDCConfig{
+		IssuerURL:   idp.server.URL,
+		ClientID:    "test-client",
+		RedirectURL: "http://app.test/auth/oidc/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.HTTPClient = idp.server.Client()
+	return provider
+}
+
+// startLogin минава през AuthCodeURL и входа при доставчика и връща кода и PKCE verifier-а
+func startLogin(t *testing.T, idp *testIdP, provider *OIDCProvider, nonce string, claims map[string]interface{}) (code, verifier string) {
+	t.Helper()
+	verifier, challenge, err := NewPKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := provider.AuthCodeURL(context.Background(), "state", nonce, challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return idp.authorize(authURL, claims), verifier
+}
+
+func TestOIDCExchange(t *testing.T) {
+	idp := newTestIdP(t)
+	provider := newTestProvider(t, idp)
+
+	code, verifier := startLogin(t, idp, provider, "nonce-1", map[string]interface{}{
+		"email":          "ana@example.com",
+		"email_verified": "true",
+	})
+	claims, err := provider.Exchange(context.Background(), code, verifier, "nonce-1")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if claims.Subject != "subject-1" || claims.Email != "ana@example.com" || !bool(claims.EmailVerified) {
+		t.Fatalf("unexpected claims: %+v", claims)
+	}
+}
+
+func TestOIDCExchangeRejectsWrongPKCEVerifier(t *testing.T) {
+	idp := newTestIdP(t)
+	provider := newTestProvider(t, idp)
+
+	code, _ := startLogin(t, idp, provider, "nonce-1", nil)
+	otherVerifier, _, err := NewPKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.Exchange(context.Background(), code, otherVerifier, "nonce-1"); err == nil {
+		t.Fatal("Exchange succeeded with a verifier that does not match the challenge")
+	}
+}
+
+func TestOIDCExchangeRejectsNonceMismatch(t *testing.T) {
+	idp := newTestIdP(t)
+	provider := newTestProvider(t, idp)
+
+	code, verifier := startLogin(t, idp, provider, "nonce-1", nil)
+	_, err := provider.Exchange(context.Background(), code, verifier, "nonce-2")
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("Exchange error = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestOIDCExchangeRejectsExpiredIDToken(t *testing.T) {
+	idp := newTestIdP(t)
+	provider := newTestProvider(t, idp)
+
+	code, verifier := startLogin(t, idp, provider, "nonce-1", map[string]interface{}{
+		"exp": time.Now().Add(-time.Minute).Unix(),
+	})
+	if _, err := provider.Exchange(context.Background(), code, verifier, "nonce-1"); err != ErrExpiredToken {
+		t.Fatalf("Exchange error = %v, want ErrExpiredToken", err)
+	}
+}
+
+func TestMemoryStateStoreIsSingleUse(t *testing.T) {
+	store := NewMemoryStateStore()
+	now := time.Now()
+	if err := store.Save(OIDCLoginState{StateHash: "h", CodeVerifier: "v", Nonce: "n", ExpiresAt: now.Add(time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := store.Take("h", now)
+	if err != nil || state.CodeVerifier != "v" || state.Nonce != "n" {
+		t.Fatalf("Take = %+v, %v", state, err)
+	}
+	if _, err := store.Take("h", now); err != ErrInvalidState {
+		t.Fatalf("replayed state: err = %v, want ErrInvalidState", err)
+	}
+}
+
+func TestMemoryStateStoreRejectsExpiredState(t *testing.T) {
+	store := NewMemoryStateStore()
+	now := time.Now()
+	store.Save(OIDCLoginState{StateHash: "h", ExpiresAt: now.Add(-time.Second)})
+
+	if _, err := store.Take("h", now); err != ErrInvalidState {
+		t.Fatalf("expired state: err = %v, want ErrInvalidState", err)
+	}
+	if _, err := store.Take("unknown", now); err != ErrInvalidState {
+		t.Fatalf("unknown state: err = %v, want ErrInvalidState", err)
+	}
+}
+
+// fakeAccounts е OIDCAccounts в паметта
+type fakeAccounts struct {
+	users      map[string]fakeUser // по имейл
+	usernames  map[string]bool
+	identities map[string]int // provider|subject -> user
+	nextID     int
+}
+
+type fakeUser struct {
+	id       int
+	verified bool
+}
+
+func newFakeAccounts() *fakeAccounts {
+	return &fakeAccounts{
+		users:      make(map[string]fakeUser),
+		usernames:  make(map[string]bool),
+		identities: make(map[string]int),
+		nextID:     100,
+	}
+}
+
+func (a *fakeAccounts) FindIdentity(provider, subject string) (int, error) {
+	if id, ok := a.identities[provider+"|"+subject]; ok {
+		return id, nil
+	}
+	return 0, ErrNotFound
+}
+
+func (a *fakeAccounts) FindUserByEmail(email string) (int, bool, error) {
+	if u, ok := a.users[email]; ok {
+		return u.id, u.verified, nil
+	}
+	return 0, false, ErrNotFound
+}
+
+func (a *fakeAccounts) LinkIdentity(userID int, provider, subject, email string) error {
+	a.identities[provider+"|"+subject] = userID
+	return nil
+}
+
+func (a *fakeAccounts) CreateUserWithIdentity(username, email, provider, subject, identityEmail string) (int, error) {
+	if a.usernames[username] {
+		return 0, ErrUsernameTaken
+	}
+	a.nextID++
+	a.usernames[username] = true
+	if email != "" {
+		a.users[email] = fakeUser{id: a.nextID, verified: true}
+	}
+	a.identities[provider+"|"+subject] = a.nextID
+	return a.nextID, nil
+}
+
+func validTestEmail(email string) bool {
+	return email != ""
+}
+
+func TestResolveOIDCUserLinksVerifiedEmail(t *testing.T) {
+	accounts := newFakeAccounts()
+	accounts.users["ana@example.com"] = fakeUser{id: 7, verified: true}
+
+	claims := &OIDCClaims{Subject: "s1", Email: "ana@example.com", EmailVerified: true}
+	userID, err := ResolveOIDCUser(accounts, "idp", claims, validTestEmail)
+	if err != nil || userID != 7 {
+		t.Fatalf("ResolveOIDCUser = %d, %v; want 7", userID, err)
+	}
+	if accounts.identities["idp|s1"] != 7 {
+		t.Fatal("identity was not linked to the existing account")
+	}
+
+	// Следващият вход намира връзката директно
+	userID, err = ResolveOIDCUser(accounts, "idp", claims, validTestEmail)
+	if err != nil || userID != 7 {
+		t.Fatalf("second login = %d, %v; want 7", userID, err)
+	}
+}
+
+func TestResolveOIDCUserRejectsUnverifiedLocalEmail(t *testing.T) {
+	accounts := newFakeAccounts()
+	accounts.users["ana@example.com"] = fakeUser{id: 7, verified: false}
+
+	claims := &OIDCClaims{Subject: "s1", Email: "ana@example.com", EmailVerified: true}
+	if _, err := ResolveOIDCUser(accounts, "idp", claims, validTestEmail); err != ErrUnverifiedEmail {
+		t.Fatalf("err = %v, want ErrUnverifiedEmail", err)
+	}
+	if len(accounts.identities) != 0 || len(accounts.usernames) != 0 {
+		t.Fatal("unverified email collision must not link or create accounts")
+	}
+}
+
+func TestResolveOIDCUserIgnoresEmailNotVerifiedByProvider(t *testing.T) {
+	accounts := newFakeAccounts()
+	accounts.users["ana@example.com"] = fakeUser{id: 7, verified: true}
+
+	claims := &OIDCClaims{Subject: "s1", Email: "ana@example.com", PreferredUsername: "ana"}
+	userID, err := ResolveOIDCUser(accounts, "idp", claims, validTestEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID == 7 {
+		t.Fatal("identity with an unverified provider email was linked to an existing account")
+	}
+	if !accounts.usernames["ana"] {
+		t.Fatal("new account was not created with the preferred username")
+	}
+}
+
+func TestResolveOIDCUserRetriesTakenUsername(t *testing.T) {
+	accounts := newFakeAccounts()
+	accounts.usernames["ana"] = true
+
+	claims := &OIDCClaims{Subject: "s1", PreferredUsername: "ana"}
+	userID, err := ResolveOIDCUser(accounts, "idp", claims, validTestEmail)
+	if err != nil || userID == 0 {
+		t.Fatalf("ResolveOIDCUser = %d, %v", userID, err)
+	}
+	if len(accounts.usernames) != 2 {
+		t.Fatalf("expected a suffixed username to be created, got %v", accounts.usernames)
+	}
+}
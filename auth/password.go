@@ -0,0 +1,99 @@
+package auth
+
+import (
+	_ "embed"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxPasswordBytes е ограничението на bcrypt - по-дългите пароли се отхвърлят от GenerateFromPassword
+const MaxPasswordBytes = 72
+
+//go:embed common_passwords.txt
+var commonPasswordsList string
+
+var commonPasswords = func() map[string]struct{} {
+	set := make(map[string]struct{})
+	for _, line := range strings.Split(commonPasswordsList, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			set[strings.ToLower(line)] = struct{}{}
+		}
+	}
+	return set
+}()
+
+// PasswordPolicy описва изискванията към новите пароли.
+type PasswordPolicy struct {
+	MinLength      int
+	RequireUpper   bool
+	RequireLower   bool
+	RequireDigit   bool
+	RequireSymbol  bool
+	RejectUsername bool
+	RejectCommon   bool
+}
+
+// PasswordViolation е едно нарушено правило от политиката.
+type PasswordViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// Validate връща всички правила, които паролата нарушава. Празен резултат означава валидна парола.
+func (p PasswordPolicy) Validate(password, username string) []PasswordViolation {
+	var violations []PasswordViolation
+
+	if utf8.RuneCountInString(password) < p.MinLength {
+		violations = append(violations, PasswordViolation{
+			Rule:    "minLength",
+			Message: fmt.Sprintf("Password must be at least %d characters long", p.MinLength),
+		})
+	}
+	if len(password) > MaxPasswordBytes {
+		violations = append(violations, PasswordViolation{
+			Rule:    "maxLength",
+			Message: fmt.Sprintf("Password must be at most %d bytes long", MaxPasswordBytes),
+		})
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			hasSymbol = true
+		}
+	}
+
+	if p.RequireUpper && !hasUpper {
+		violations = append(violations, PasswordViolation{Rule: "upper", Message: "Password must contain an uppercase letter"})
+	}
+	if p.RequireLower && !hasLower {
+		violations = append(violations, PasswordViolation{Rule: "lower", Message: "Password must contain a lowercase letter"})
+	}
+	if p.RequireDigit && !hasDigit {
+		violations = append(violations, PasswordViolation{Rule: "digit", Message: "Password must contain a digit"})
+	}
+	if p.RequireSymbol && !hasSymbol {
+		violations = append(violations, PasswordViolation{Rule: "symbol", Message: "Password must contain a symbol"})
+	}
+
+	lower := strings.ToLower(password)
+	if p.RejectUsername && username != "" && strings.Contains(lower, strings.ToLower(username)) {
+		violations = append(violations, PasswordViolation{Rule: "username", Message: "Password must not contain the username"})
+	}
+	if p.RejectCommon {
+		if _, ok := commonPasswords[lower]; ok {
+			violations = append(violations, PasswordViolation{Rule: "common", Message: "Password is too common"})
+		}
+	}
+
+	return violations
+}
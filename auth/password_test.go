@@ -0,0 +1,22 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicyRejectsPasswordsLongerThanBcryptAllows(t *testing.T) {
+	policy := PasswordPolicy{MinLength: 8}
+
+	if violations := policy.Validate(strings.Repeat("a", MaxPasswordBytes), ""); len(violations) != 0 {
+		t.Fatalf("72-byte password rejected: %v", violations)
+	}
+
+	// Кирилицата е по два байта на буква, затова 37 букви са над ограничението
+	for _, password := range []string{strings.Repeat("a", MaxPasswordBytes+1), strings.Repeat("ж", 37)} {
+		violations := policy.Validate(password, "")
+		if len(violations) != 1 || violations[0].Rule != "maxLength" {
+			t.Errorf("Validate(%d bytes) = %v, want maxLength", len(password), violations)
+		}
+	}
+}
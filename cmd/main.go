@@ -1,32 +1,91 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
+	"net/mail"
+	"net/url"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
+	"weight-challenge/auth"
+	"weight-challenge/config"
+	"weight-challenge/importer"
+	"weight-challenge/mailer"
+	"weight-challenge/migrations"
 	"weight-challenge/models"
+	"weight-challenge/ratelimit"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	_ "github.com/go-sql-driver/mysql"
-	"github.com/joho/godotenv"
 	"golang.org/x/crypto/bcrypt"
 )
 
-var db *sql.DB
+const (
+	twoFactorIssuer       = "Weight Challenge"
+	twoFactorChallengeTTL = 5 * time.Minute
+	twoFactorMaxAttempts  = 5
+	recoveryCodeCount     = 10
+	oidcStateTTL          = 10 * time.Minute
+	oidcStateCookie       = "oidc_state"
+	oidcCookiePath        = "/auth/oidc"
+	reauthWindow          = 5 * time.Minute
+	maxImportSize         = 5 << 20
+	maxAuthBodySize       = 64 << 10
+	exportFlushEvery      = 500
+	idempotencyKeyTTL     = 24 * time.Hour
+	idempotencyPurgeEvery = time.Hour
+	maxIdempotencyKeyLen  = 255
+)
 
-func main() {
-	var err error
+var (
+	db         *sql.DB
+	tokens     *auth.TokenSigner
+	refreshTTL time.Duration
+
+	// apiURL е публичният адрес за връзките в писмата
+	apiURL string
+
+	mailSender           mailer.Mailer
+	passwordResetTTL     time.Duration
+	emailVerificationTTL time.Duration
+	requireVerifiedEmail bool
+
+	passwordPolicy auth.PasswordPolicy
+
+	oidcProvider     *auth.OIDCProvider
+	oidcProviderName string
+	oidcStates       auth.OIDCStateStore
+	oidcAccounts     auth.OIDCAccounts
+
+	authLimiter      *ratelimit.Limiter
+	lockoutThreshold int
+	lockoutDuration  time.Duration
+)
 
-	// Зареждане на .env файл
-	if err = godotenv.Load(); err != nil {
-		log.Fatal("Error loading .env file")
+func main() {
+	// Настройките идват от стойностите по подразбиране, .env или YAML файл,
+	// променливите на средата и флаговете - всички грешки се показват наведнъж
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
 	}
+	apiURL = cfg.APIURL
 
 	// Създаваме директория за логове ако не съществува
 	if err = os.MkdirAll("logs", 0755); err != nil {
@@ -41,8 +100,7 @@ func main() {
 	defer logFile.Close()
 
 	// Конфигурираме логването според средата
-	appEnv := os.Getenv("APP_ENV")
-	if appEnv == "development" {
+	if cfg.IsDevelopment() {
 		// В development режим логваме във файл и в конзолата
 		log.SetOutput(io.MultiWriter(logFile, os.Stdout))
 		gin.SetMode(gin.DebugMode)
@@ -55,16 +113,9 @@ func main() {
 	// Задаваме формат на логовете
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 
-	// Свързване с базата данни
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=%s&parseTime=True&loc=Local",
-		os.Getenv("DB_USER"),
-		os.Getenv("DB_PASSWORD"),
-		os.Getenv("DB_HOST"),
-		os.Getenv("DB_PORT"),
-		os.Getenv("DB_NAME"),
-		os.Getenv("DB_CHARSET"))
-
-	db, err = sql.Open("mysql", dsn)
+	// Свързване с базата данни. Времената се пазят в UTC независимо от зоната на
+	// сървъра; дневните граници се смятат в зоната на всеки потребител.
+	db, err = sql.Open("mysql", cfg.DSN())
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -74,70 +125,182 @@ func main() {
 		log.Fatal("Could not connect to database:", err)
 	}
 
-	log.Printf("Server starting in %s mode", appEnv)
+	// Довеждаме съществуваща база до текущата схема - новите колони не идват от CREATE TABLE
+	if err = migrations.Run(db); err != nil {
+		log.Fatal("Could not migrate database:", err)
+	}
+
+	// Настройки за подписване на токените
+	tokens, err = auth.NewTokenSigner(cfg.Token.Secret, cfg.Token.Issuer, cfg.Token.TTL)
+	if err != nil {
+		log.Fatal("Error configuring tokens:", err)
+	}
+	refreshTTL = cfg.Token.RefreshTTL
+
+	// В development писмата се записват локално вместо да се изпращат
+	if cfg.Mail.Driver == config.MailDriverSMTP {
+		mailSender, err = mailer.NewSMTPMailer(
+			cfg.Mail.SMTPHost,
+			strconv.Itoa(cfg.Mail.SMTPPort),
+			cfg.Mail.SMTPUsername,
+			cfg.Mail.SMTPPassword,
+			cfg.Mail.From)
+	} else {
+		mailSender, err = mailer.NewFileMailer(cfg.Mail.Dir)
+	}
+	if err != nil {
+		log.Fatal("Error configuring mailer:", err)
+	}
+	passwordResetTTL = cfg.Mail.PasswordResetTTL
+	emailVerificationTTL = cfg.Mail.EmailVerificationTTL
+	requireVerifiedEmail = cfg.Mail.RequireVerifiedEmail
+
+	// Политика за паролите
+	passwordPolicy = auth.PasswordPolicy{
+		MinLength:      cfg.Password.MinLength,
+		RequireUpper:   cfg.Password.RequireUpper,
+		RequireLower:   cfg.Password.RequireLower,
+		RequireDigit:   cfg.Password.RequireDigit,
+		RequireSymbol:  cfg.Password.RequireSymbol,
+		RejectUsername: cfg.Password.RejectUsername,
+		RejectCommon:   cfg.Password.RejectCommon,
+	}
+
+	// Вход чрез външен OpenID Connect доставчик (по избор)
+	if cfg.OIDC.IssuerURL != "" {
+		oidcProvider, err = auth.NewOIDCProvider(auth.OIDCConfig{
+			IssuerURL:    cfg.OIDC.IssuerURL,
+			ClientID:     cfg.OIDC.ClientID,
+			ClientSecret: cfg.OIDC.ClientSecret,
+			RedirectURL:  cfg.OIDC.RedirectURL,
+		})
+		if err != nil {
+			log.Fatal("Error configuring OIDC:", err)
+		}
+		oidcProviderName = cfg.OIDC.ProviderName
+		oidcStates = auth.NewMySQLStateStore(db)
+		oidcAccounts = auth.NewMySQLOIDCAccounts(db)
+	}
+
+	// Ограничаване на опитите за вход и възстановяване на парола
+	var limitStore ratelimit.Store = ratelimit.NewMemoryStore()
+	if cfg.RateLimit.Store == config.RateLimitStoreMySQL {
+		limitStore = ratelimit.NewMySQLStore(db)
+	}
+	authLimiter = ratelimit.NewLimiter(limitStore, cfg.RateLimit.AuthPerMinute, cfg.RateLimit.AuthBurst)
+	lockoutThreshold = cfg.RateLimit.LockoutThreshold
+	lockoutDuration = cfg.RateLimit.LockoutDuration
+
+	// Изтеклите Idempotency-Key ключове се трият във фонов режим
+	go purgeExpiredIdempotencyKeys(idempotencyPurgeEvery)
+
+	log.Printf("Server starting in %s mode", cfg.Env)
 	log.Println("Successfully connected to database")
 	defer db.Close()
 
 	r := gin.Default()
 
 	// Конфигурираме Gin logger според средата
-	if appEnv == "development" {
+	if cfg.IsDevelopment() {
 		r.Use(gin.Logger())
 	}
 
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"},
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "Idempotency-Key"},
+		ExposeHeaders:    []string{"Content-Length", "Idempotent-Replayed"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
 
 	r.Static("/static", "./static")
 	r.StaticFile("/", "./static/index.html")
+	// Service worker-ът се обслужва от корена, за да контролира и страницата на "/"
+	r.StaticFile("/sw.js", "./static/sw.js")
 
 	// Автентикация
 	r.POST("/register", register)
-	r.POST("/login", login)
-	r.POST("/reset-password", resetPassword)
+	r.POST("/login", authRateLimitMiddleware(), login)
+	r.POST("/reset-password", authRateLimitMiddleware(), resetPassword)
+	r.POST("/reset-password/confirm", authRateLimitMiddleware(), confirmPasswordReset)
+	r.POST("/login/2fa", authRateLimitMiddleware(), completeTwoFactorLogin)
+	r.POST("/token/refresh", refreshToken)
+	r.GET("/auth/oidc/login", oidcLogin)
+	r.GET("/auth/oidc/callback", oidcCallback)
+	r.GET("/verify-email", verifyEmail)
+
+	// Idempotency-Key се приема само при промените по данните. Отговорите се пазят в
+	// базата, затова endpoints, които връщат токени, 2FA тайни или кодове, са изключени.
+	idempotent := idempotencyMiddleware()
 
 	// Защитени endpoints
 	authorized := r.Group("/")
 	authorized.Use(authMiddleware())
 	{
-		authorized.POST("/weight", addWeight)
+		authorized.POST("/weight", idempotent, addWeight)
 		authorized.GET("/weight/stats", getWeightStats)
-		authorized.DELETE("/weight/:id", deleteWeight)
+		authorized.GET("/weight/history", getWeightHistory)
+		authorized.GET("/weight/projection", getWeightProjection)
+		authorized.GET("/weight/aggregate", getWeightAggregate)
+		authorized.POST("/weight/import", idempotent, importWeights)
+		authorized.GET("/weight/export", exportWeights)
+		authorized.PUT("/weight/:id", idempotent, updateWeight)
+		authorized.PATCH("/weight/:id", idempotent, patchWeight)
+		authorized.DELETE("/weight/:id", idempotent, deleteWeight)
+		authorized.GET("/sync", getSyncChanges)
+		authorized.POST("/sync", idempotent, pushSyncChanges)
 		authorized.GET("/user/settings", getUserSettings)
-		authorized.PUT("/user/settings", updateUserSettings)
+		authorized.PUT("/user/settings", idempotent, updateUserSettings)
 		authorized.PUT("/user/password", changePassword)
+		authorized.POST("/logout", logout)
+		authorized.POST("/logout-all", logoutAll)
+
+		authorized.POST("/user/email/verify", resendEmailVerification)
+		authorized.POST("/user/2fa/setup", setupTwoFactor)
+		authorized.POST("/user/2fa/enable", enableTwoFactor)
+		authorized.POST("/user/2fa/disable", disableTwoFactor)
+		authorized.GET("/user/export", exportUserData)
+		authorized.DELETE("/user", deleteAccount)
+	}
+
+	// Администрация
+	admin := authorized.Group("/admin")
+	admin.Use(requireRole(models.RoleModerator))
+	{
+		admin.GET("/users", adminListUsers)
+		admin.DELETE("/friendships/:friendshipId", adminDeleteFriendship)
+		admin.DELETE("/challenges/:challengeId", adminDeleteChallenge)
 
+		admin.PUT("/users/:userId/role", requireRole(models.RoleAdmin), adminSetUserRole)
+		admin.PUT("/users/:userId/disabled", requireRole(models.RoleAdmin), adminSetUserDisabled)
+		admin.POST("/users/:userId/force-password-reset", requireRole(models.RoleAdmin), adminForcePasswordReset)
+	}
+
+	// Социалните функции могат да изискват потвърден имейл
+	social := authorized.Group("/")
+	social.Use(verifiedEmailMiddleware())
+	{
 		// Нови endpoints за социални функции
-		authorized.GET("/users", getVisibleUsers)
-		authorized.PUT("/user/visibility", updateVisibility)
+		social.GET("/users", getVisibleUsers)
+		social.PUT("/user/visibility", idempotent, updateVisibility)
 
 		// Приятелства
-		authorized.GET("/friends", getFriends)
-		authorized.POST("/friends/request/:userId", sendFriendRequest)
-		authorized.POST("/friends/accept/:friendshipId", acceptFriendRequest)
-		authorized.POST("/friends/reject/:friendshipId", rejectFriendRequest)
+		social.GET("/friends", getFriends)
+		social.POST("/friends/request/:userId", idempotent, sendFriendRequest)
+		social.POST("/friends/accept/:friendshipId", idempotent, acceptFriendRequest)
+		social.POST("/friends/reject/:friendshipId", idempotent, rejectFriendRequest)
 
 		// Съревнования
-		authorized.GET("/challenges", getChallenges)
-		authorized.POST("/challenges", createChallenge)
-		authorized.PUT("/challenges/:challengeId/accept", acceptChallenge)
-		authorized.PUT("/challenges/:challengeId/reject", rejectChallenge)
-		authorized.GET("/challenges/:challengeId/results", getChallengeResults)
-	}
-
-	port := os.Getenv("SERVER_PORT")
-	if port == "" {
-		port = "8080"
+		social.GET("/challenges", getChallenges)
+		social.POST("/challenges", idempotent, createChallenge)
+		social.PUT("/challenges/:challengeId/accept", idempotent, acceptChallenge)
+		social.PUT("/challenges/:challengeId/reject", idempotent, rejectChallenge)
+		social.GET("/challenges/:challengeId/results", getChallengeResults)
 	}
 
-	log.Printf("Server starting on http://%s:%s", os.Getenv("API_URL"), port)
-	r.Run(":" + port)
+	log.Printf("Server starting on port %d (%s)", cfg.Server.Port, apiURL)
+	r.Run(fmt.Sprintf(":%d", cfg.Server.Port))
 }
 
 // func register(c *gin.Context) {
@@ -238,6 +401,27 @@ func register(c *gin.Context) {
 		return
 	}
 
+	if user.Email != "" && !isValidEmail(user.Email) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email address"})
+		return
+	}
+
+	if !checkPasswordPolicy(c, user.Password, user.Username) {
+		return
+	}
+
+	if !resolveUnitPreferences(c, &user) {
+		return
+	}
+
+	if user.Timezone == "" {
+		user.Timezone = models.DefaultTimezone
+	}
+	if _, err := models.LoadTimezone(user.Timezone); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	// Debug logging
 	log.Printf("Registration attempt - Username: %s, Password length: %d",
 		user.Username, len(user.Password))
@@ -267,9 +451,9 @@ func register(c *gin.Context) {
 
 	// Запис в базата
 	result, err := db.Exec(`
-        INSERT INTO users (username, password, height) 
-        VALUES (?, ?, ?)`,
-		user.Username, string(hashedPassword), user.Height)
+        INSERT INTO users (username, password, height, email, weight_unit, height_unit, timezone) 
+        VALUES (?, ?, ?, NULLIF(?, ''), ?, ?, ?)`,
+		user.Username, string(hashedPassword), user.Height, user.Email, user.WeightUnit, user.HeightUnit, user.Timezone)
 	if err != nil {
 		log.Printf("Database error inserting user: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create user"})
@@ -279,6 +463,14 @@ func register(c *gin.Context) {
 	id, _ := result.LastInsertId()
 	user.ID = int(id)
 	user.Password = "" // Не връщаме паролата
+	user.ConvertTo(user.WeightUnit, user.HeightUnit)
+
+	// Регистрацията не зависи от доставката на писмото - то може да се изпрати отново
+	if user.Email != "" {
+		if err := sendEmailVerification(user.ID, user.Email); err != nil {
+			log.Printf("Error sending verification email to user %d: %v", user.ID, err)
+		}
+	}
 
 	log.Printf("Successfully registered user: ID=%d, Username=%s", user.ID, user.Username)
 
@@ -317,11 +509,14 @@ func login(c *gin.Context) {
 
 	var user models.User
 	var hashedPassword string
+	var lockedUntil sql.NullTime
+	var totpEnabled, disabled bool
 	err := db.QueryRow(`
-        SELECT id, username, password, height 
+        SELECT id, username, password, height, role, locked_until, totp_enabled, disabled_at IS NOT NULL 
         FROM users 
         WHERE username = ?`,
-		credentials.Username).Scan(&user.ID, &user.Username, &hashedPassword, &user.Height)
+		credentials.Username).Scan(&user.ID, &user.Username, &hashedPassword, &user.Height, &user.Role,
+		&lockedUntil, &totpEnabled, &disabled)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -334,952 +529,4612 @@ func login(c *gin.Context) {
 		return
 	}
 
+	// Проверяваме дали акаунтът не е временно заключен
+	if lockedUntil.Valid && time.Now().Before(lockedUntil.Time) {
+		log.Printf("Login attempt for locked user: %s", credentials.Username)
+		respondTooManyRequests(c, time.Until(lockedUntil.Time), "Account temporarily locked")
+		return
+	}
+
 	// Проверка на паролата
 	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(credentials.Password))
 	if err != nil {
 		log.Printf("Invalid password for user %s: %v", credentials.Username, err)
+		if err := recordFailedLogin(user.ID); err != nil {
+			log.Printf("Error recording failed login: %v", err)
+		}
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
 
-	// Създаваме токен с потребителското ID
-	token := fmt.Sprintf("user-%d", user.ID)
+	if disabled {
+		log.Printf("Login attempt for disabled user: %s", credentials.Username)
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account disabled"})
+		return
+	}
+
+	// При включена 2FA сесия се издава едва след проверка на кода, а брояча на
+	// неуспешните опити нулираме чак тогава, за да важи заключването и за кодовете
+	if totpEnabled {
+		challengeToken, expiresAt, err := startTwoFactorChallenge(user.ID)
+		if err != nil {
+			log.Printf("Error starting 2FA challenge: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not start 2FA"})
+			return
+		}
+
+		log.Printf("2FA required for user: %s", credentials.Username)
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":           "2FA required",
+			"twoFactorRequired": true,
+			"challengeToken":    challengeToken,
+			"expiresAt":         expiresAt,
+		})
+		return
+	}
+
+	resetFailedLogins(user.ID)
+
+	// Създаваме нова сесия и подписан токен с потребителското ID
+	session, err := issueSession(db, c, user.ID)
+	if err != nil {
+		log.Printf("Error creating session: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create session"})
+		return
+	}
 
 	log.Printf("Successful login for user: %s", credentials.Username)
 
 	c.JSON(http.StatusOK, gin.H{
-		"message": "Login successful",
-		"user":    user,
-		"token":   token,
+		"message":      "Login successful",
+		"user":         user,
+		"token":        session.Token,
+		"expiresAt":    session.ExpiresAt,
+		"refreshToken": session.RefreshToken,
 	})
 }
 
-func CheckPasswordHash(password, storedHash string) bool {
-	// Debug информация
-	log.Printf("Checking password: %s", password)
-	log.Printf("Against stored hash: %s", storedHash)
-	log.Printf("Password length: %d", len(password))
-	log.Printf("Stored hash length: %d", len(storedHash))
+// startTwoFactorChallenge записва незавършен вход, който се довършва с POST /login/2fa
+func startTwoFactorChallenge(userID int) (string, time.Time, error) {
+	challengeToken, challengeHash, err := auth.NewOpaqueToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
 
-	// Проверка на хеша
-	err := bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(password))
+	expiresAt := time.Now().Add(twoFactorChallengeTTL)
+	_, err = db.Exec(`
+        INSERT INTO two_factor_challenges (user_id, token_hash, expires_at)
+        VALUES (?, ?, ?)`,
+		userID, challengeHash, expiresAt)
 	if err != nil {
-		log.Printf("Password check failed: %v", err)
-		return false
+		return "", time.Time{}, err
 	}
 
-	return true
+	return challengeToken, expiresAt, nil
 }
 
-func addWeight(c *gin.Context) {
-	var input models.WeightRecordInput
-	if err := c.BindJSON(&input); err != nil {
-		log.Printf("Error binding JSON: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+func completeTwoFactorLogin(c *gin.Context) {
+	var req struct {
+		ChallengeToken string `json:"challengeToken"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recoveryCode"`
 	}
 
-	userID := getUserID(c)
-
-	// Парсване на датата
-	createdAt, err := time.Parse(time.RFC3339, input.CreatedAt)
-	if err != nil {
-		log.Printf("Error parsing date: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date format"})
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
 		return
 	}
 
-	record := models.WeightRecord{
-		UserID:    userID,
-		Weight:    input.Weight,
-		CreatedAt: createdAt,
+	if req.ChallengeToken == "" || (req.Code == "" && req.RecoveryCode == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Challenge token and code are required"})
+		return
 	}
 
-	result, err := db.Exec("INSERT INTO weight_records (user_id, weight, created_at) VALUES (?, ?, ?)",
-		record.UserID, record.Weight, record.CreatedAt)
+	var challengeID, attempts int
+	var expiresAt time.Time
+	var usedAt sql.NullTime
+	var user models.User
+	var totpSecret sql.NullString
+	var lastStep int64
+	var recoveryCodes sql.NullString
+	var lockedUntil sql.NullTime
+	err := db.QueryRow(`
+        SELECT tc.id, tc.attempts, tc.expires_at, tc.used_at,
+               u.id, u.username, u.height, u.role, u.totp_secret, u.totp_last_step, u.recovery_codes, u.locked_until
+        FROM two_factor_challenges tc
+        JOIN users u ON u.id = tc.user_id
+        WHERE tc.token_hash = ?`,
+		auth.HashToken(req.ChallengeToken)).Scan(
+		&challengeID, &attempts, &expiresAt, &usedAt,
+		&user.ID, &user.Username, &user.Height, &user.Role, &totpSecret, &lastStep, &recoveryCodes, &lockedUntil)
 	if err != nil {
-		log.Printf("Error saving weight record: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not save weight record"})
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired 2FA challenge"})
+			return
+		}
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
 
-	id, _ := result.LastInsertId()
-	record.ID = int(id)
-
-	c.JSON(http.StatusOK, record)
-}
-
-func getWeightStats(c *gin.Context) {
-	userID := getUserID(c)
-
-	var stats models.WeightStats
+	if usedAt.Valid || attempts >= twoFactorMaxAttempts || time.Now().After(expiresAt) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired 2FA challenge"})
+		return
+	}
 
-	// Вземаме височината на потребителя
-	err := db.QueryRow("SELECT height FROM users WHERE id = ?", userID).Scan(&stats.Height)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch user data"})
+	// Акаунтът може да е заключен от грешни кодове в друго предизвикателство
+	if lockedUntil.Valid && time.Now().Before(lockedUntil.Time) {
+		respondTooManyRequests(c, time.Until(lockedUntil.Time), "Account temporarily locked")
 		return
 	}
 
-	// Вземаме всички записи, сортирани по дата
-	rows, err := db.Query(`
-		SELECT id, weight, created_at 
-		FROM weight_records 
-		WHERE user_id = ? 
-		ORDER BY created_at DESC`, userID)
+	valid := false
+	if req.Code != "" {
+		var step int64
+		step, valid = auth.ValidateTOTP(totpSecret.String, req.Code, time.Now(), lastStep)
+		if valid {
+			// Запомняме периода, за да не се приеме същият код повторно
+			var result sql.Result
+			result, err = db.Exec("UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?", step, user.ID, step)
+			if err == nil {
+				if rows, _ := result.RowsAffected(); rows == 0 {
+					valid = false
+				}
+			}
+		}
+	} else {
+		var remaining []string
+		remaining, valid = useRecoveryCode(recoveryCodes.String, req.RecoveryCode)
+		if valid {
+			// Условието по старата стойност пречи един код да се използва от две паралелни заявки
+			encoded, _ := json.Marshal(remaining)
+			var result sql.Result
+			result, err = db.Exec("UPDATE users SET recovery_codes = ? WHERE id = ? AND recovery_codes = ?",
+				string(encoded), user.ID, recoveryCodes.String)
+			if err == nil {
+				if rows, _ := result.RowsAffected(); rows == 0 {
+					valid = false
+				}
+			}
+		}
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch weight records"})
+		log.Printf("Error updating 2FA state: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
-	defer rows.Close()
 
-	var records []models.WeightRecord
-	for rows.Next() {
-		var record models.WeightRecord
-		if err := rows.Scan(&record.ID, &record.Weight, &record.CreatedAt); err != nil {
-			continue
+	if !valid {
+		_, err = db.Exec("UPDATE two_factor_challenges SET attempts = attempts + 1 WHERE id = ?", challengeID)
+		if err != nil {
+			log.Printf("Error recording 2FA attempt: %v", err)
 		}
-		records = append(records, record)
+		if err := recordFailedLogin(user.ID); err != nil {
+			log.Printf("Error recording failed login: %v", err)
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid 2FA code"})
+		return
+	}
+
+	result, err := db.Exec(`
+        UPDATE two_factor_challenges
+        SET used_at = CURRENT_TIMESTAMP
+        WHERE id = ? AND used_at IS NULL`, challengeID)
+	if err != nil {
+		log.Printf("Error completing 2FA challenge: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired 2FA challenge"})
+		return
 	}
 
-	if len(records) > 0 {
-		stats.CurrentWeight = records[0].Weight
-		stats.InitialWeight = records[len(records)-1].Weight
-		stats.TotalProgress = models.CalculateProgress(stats.InitialWeight, stats.CurrentWeight)
-		stats.BMI = models.CalculateBMI(stats.CurrentWeight, stats.Height)
+	resetFailedLogins(user.ID)
 
-		if len(records) > 1 {
-			stats.PreviousWeight = records[1].Weight
-			stats.DailyProgress = models.CalculateProgress(stats.PreviousWeight, stats.CurrentWeight)
-		}
+	session, err := issueSession(db, c, user.ID)
+	if err != nil {
+		log.Printf("Error creating session: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create session"})
+		return
 	}
 
-	stats.History = records
+	log.Printf("Successful 2FA login for user: %s", user.Username)
 
-	c.JSON(http.StatusOK, stats)
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Login successful",
+		"user":         user,
+		"token":        session.Token,
+		"expiresAt":    session.ExpiresAt,
+		"refreshToken": session.RefreshToken,
+	})
 }
 
-func authMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		token := c.GetHeader("Authorization")
-		if token == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "No token provided"})
-			c.Abort()
-			return
-		}
+// useRecoveryCode търси кода сред хешираните резервни кодове и връща останалите
+func useRecoveryCode(stored, code string) ([]string, bool) {
+	var hashes []string
+	if stored == "" || json.Unmarshal([]byte(stored), &hashes) != nil {
+		return nil, false
+	}
 
-		// Извличаме ID-то от токена
-		var userID int
-		_, err := fmt.Sscanf(token, "user-%d", &userID)
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-			c.Abort()
-			return
+	code = strings.ToLower(strings.TrimSpace(code))
+	for i, hash := range hashes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) == nil {
+			return append(hashes[:i:i], hashes[i+1:]...), true
 		}
-
-		// Запазваме ID-то в контекста
-		c.Set("userID", userID)
-		c.Next()
 	}
+	return nil, false
 }
 
-func getUserID(c *gin.Context) int {
-	// Взимаме ID-то от контекста
-	userID, exists := c.Get("userID")
-	if !exists {
-		return 0
+func setupTwoFactor(c *gin.Context) {
+	userID := getUserID(c)
+
+	var username string
+	var enabled bool
+	err := db.QueryRow("SELECT username, totp_enabled FROM users WHERE id = ?", userID).Scan(&username, &enabled)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch user data"})
+		return
 	}
-	return userID.(int)
-}
 
-func getUserSettings(c *gin.Context) {
-	userID := getUserID(c)
+	if enabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "2FA is already enabled"})
+		return
+	}
 
-	var user models.User
-	err := db.QueryRow(`
-        SELECT u.id, u.username, u.first_name, u.last_name, u.age, u.height, u.gender, u.email, u.target_weight, us.is_visible
-        FROM users u
-        LEFT JOIN user_settings us ON u.id = us.user_id
-        WHERE u.id = ?`, userID).Scan(
-		&user.ID, &user.Username, &user.FirstName, &user.LastName,
-		&user.Age, &user.Height, &user.Gender, &user.Email, &user.Target, &user.IsVisible)
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		log.Printf("Error generating TOTP secret: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not set up 2FA"})
+		return
+	}
 
+	// Ключът се пази, но 2FA се включва едва след потвърждение с код
+	_, err = db.Exec("UPDATE users SET totp_secret = ?, totp_last_step = 0 WHERE id = ?", secret, userID)
 	if err != nil {
-		log.Printf("Error fetching user settings: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch user settings"})
+		log.Printf("Error saving TOTP secret: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not set up 2FA"})
 		return
 	}
 
-	c.JSON(http.StatusOK, user)
+	c.JSON(http.StatusOK, gin.H{
+		"secret":          secret,
+		"provisioningUri": auth.TOTPProvisioningURI(twoFactorIssuer, username, secret),
+	})
 }
 
-func updateUserSettings(c *gin.Context) {
+func enableTwoFactor(c *gin.Context) {
 	userID := getUserID(c)
-	var settings models.User
+	var req struct {
+		Code string `json:"code"`
+	}
 
-	if err := c.BindJSON(&settings); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+	if err := c.BindJSON(&req); err != nil || req.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Code is required"})
 		return
 	}
 
-	_, err := db.Exec(`
-        UPDATE users 
-        SET first_name = ?, last_name = ?, age = ?, height = ?, 
-            gender = ?, email = ?, target_weight = ?, updated_at = CURRENT_TIMESTAMP
-        WHERE id = ?`,
-		settings.FirstName, settings.LastName, settings.Age, settings.Height,
-		settings.Gender, settings.Email, settings.Target, userID)
+	var secret sql.NullString
+	var enabled bool
+	err := db.QueryRow("SELECT totp_secret, totp_enabled FROM users WHERE id = ?", userID).Scan(&secret, &enabled)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch user data"})
+		return
+	}
+
+	if enabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "2FA is already enabled"})
+		return
+	}
+	if !secret.Valid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "2FA setup has not been started"})
+		return
+	}
 
+	step, valid := auth.ValidateTOTP(secret.String, req.Code, time.Now(), 0)
+	if !valid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 2FA code"})
+		return
+	}
+
+	codes, err := auth.NewRecoveryCodes(recoveryCodeCount)
 	if err != nil {
-		log.Printf("Error updating user settings: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update settings"})
+		log.Printf("Error generating recovery codes: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not enable 2FA"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Settings updated successfully"})
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not enable 2FA"})
+			return
+		}
+		hashes[i] = string(hash)
+	}
+	encoded, _ := json.Marshal(hashes)
+
+	_, err = db.Exec(`
+        UPDATE users
+        SET totp_enabled = true, totp_last_step = ?, recovery_codes = ?
+        WHERE id = ?`,
+		step, string(encoded), userID)
+	if err != nil {
+		log.Printf("Error enabling 2FA: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not enable 2FA"})
+		return
+	}
+
+	// Резервните кодове се показват само веднъж
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "2FA enabled",
+		"recoveryCodes": codes,
+	})
 }
 
-func changePassword(c *gin.Context) {
+func disableTwoFactor(c *gin.Context) {
 	userID := getUserID(c)
 	var req struct {
-		CurrentPassword string `json:"currentPassword"`
-		NewPassword     string `json:"newPassword"`
+		Password string `json:"password"`
 	}
 
-	if err := c.BindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+	if err := c.BindJSON(&req); err != nil || req.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password is required"})
 		return
 	}
 
-	// Проверка на текущата парола
 	var storedHash string
 	err := db.QueryRow("SELECT password FROM users WHERE id = ?", userID).Scan(&storedHash)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not verify current password"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch user data"})
 		return
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(req.CurrentPassword)); err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Current password is incorrect"})
+	if err := bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(req.Password)); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Password is incorrect"})
 		return
 	}
 
-	// Хеширане и запазване на новата парола
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	_, err = db.Exec(`
+        UPDATE users
+        SET totp_enabled = false, totp_secret = NULL, totp_last_step = 0, recovery_codes = NULL
+        WHERE id = ?`, userID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not process new password"})
+		log.Printf("Error disabling 2FA: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not disable 2FA"})
 		return
 	}
 
-	_, err = db.Exec("UPDATE users SET password = ? WHERE id = ?", string(hashedPassword), userID)
+	c.JSON(http.StatusOK, gin.H{"message": "2FA disabled"})
+}
+
+// recordFailedLogin брои неуспешните опити и заключва акаунта след lockoutThreshold поредни
+func recordFailedLogin(userID int) error {
+	_, err := db.Exec("UPDATE users SET failed_login_attempts = failed_login_attempts + 1 WHERE id = ?", userID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update password"})
-		return
+		return err
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Password changed successfully"})
-}
-
-func getVisibleUsers(c *gin.Context) {
+	result, err := db.Exec(`
+        UPDATE users
+        SET locked_until = ?, failed_login_attempts = 0
+        WHERE id = ? AND failed_login_attempts >= ?`,
+		time.Now().Add(lockoutDuration), userID, lockoutThreshold)
+	if err != nil {
+		return err
+	}
+
+	if rows, _ := result.RowsAffected(); rows > 0 {
+		log.Printf("User %d locked for %s after %d failed logins", userID, lockoutDuration, lockoutThreshold)
+	}
+	return nil
+}
+
+// resetFailedLogins нулира брояча след напълно успешен вход
+func resetFailedLogins(userID int) {
+	_, err := db.Exec("UPDATE users SET failed_login_attempts = 0, locked_until = NULL WHERE id = ?", userID)
+	if err != nil {
+		log.Printf("Error resetting failed logins: %v", err)
+	}
+}
+
+func respondTooManyRequests(c *gin.Context, retryAfter time.Duration, message string) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": message, "retryAfter": seconds})
+}
+
+// authRateLimitMiddleware ограничава заявките по IP адрес и по потребителско име от тялото
+func authRateLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		keys := []string{"ip:" + c.ClientIP()}
+
+		// Прочитаме тялото и го връщаме обратно за handler-а
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxAuthBodySize))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body is too large"})
+			} else {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			}
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		var req struct {
+			Username string `json:"username"`
+		}
+		if json.Unmarshal(body, &req) == nil && req.Username != "" {
+			// Хешираме името, за да се събере в rate_limits.bucket_key при всякаква дължина
+			keys = append(keys, "user:"+auth.HashToken(strings.ToLower(req.Username)))
+		}
+
+		for _, key := range keys {
+			allowed, retryAfter, err := authLimiter.Allow(c.FullPath() + "|" + key)
+			if err != nil {
+				// При проблем с хранилището не блокираме потребителите
+				log.Printf("Rate limiter error: %v", err)
+				continue
+			}
+			if !allowed {
+				log.Printf("Rate limit exceeded for %s on %s", key, c.FullPath())
+				respondTooManyRequests(c, retryAfter, "Too many requests")
+				c.Abort()
+				return
+			}
+		}
+
+		c.Next()
+	}
+}
+
+type sessionTokens struct {
+	Token        string    `json:"token"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+	RefreshToken string    `json:"refreshToken"`
+}
+
+// execer е общото между *sql.DB и *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// issueSession записва нова сесия и връща токен за достъп и refresh токен за нея
+func issueSession(ex execer, c *gin.Context, userID int) (*sessionTokens, error) {
+	refreshToken, refreshHash, err := auth.NewOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+
+	userAgent := c.Request.UserAgent()
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+
+	result, err := ex.Exec(`
+        INSERT INTO sessions (user_id, refresh_token_hash, user_agent, ip_address, expires_at)
+        VALUES (?, ?, ?, ?, ?)`,
+		userID, refreshHash, userAgent, c.ClientIP(), time.Now().Add(refreshTTL))
+	if err != nil {
+		return nil, err
+	}
+
+	sessionID, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	token, expiresAt, err := tokens.Sign(userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sessionTokens{Token: token, ExpiresAt: expiresAt, RefreshToken: refreshToken}, nil
+}
+
+// revokeUserSessions прекратява всички активни сесии на потребителя
+func revokeUserSessions(ex execer, userID int) error {
+	_, err := ex.Exec(`
+        UPDATE sessions
+        SET revoked_at = CURRENT_TIMESTAMP
+        WHERE user_id = ? AND revoked_at IS NULL`, userID)
+	return err
+}
+
+func refreshToken(c *gin.Context) {
+	var req struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+
+	if err := c.BindJSON(&req); err != nil || req.RefreshToken == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Refresh token is required"})
+		return
+	}
+
+	oldHash := auth.HashToken(req.RefreshToken)
+
+	var sessionID int64
+	var userID int
+	var expiresAt time.Time
+	var revokedAt sql.NullTime
+	err := db.QueryRow(`
+        SELECT id, user_id, expires_at, revoked_at
+        FROM sessions
+        WHERE refresh_token_hash = ?`,
+		oldHash).Scan(&sessionID, &userID, &expiresAt, &revokedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+			return
+		}
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if revokedAt.Valid || time.Now().After(expiresAt) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Session expired"})
+		return
+	}
+
+	// Ротираме refresh токена, за да не може старият да се използва повторно
+	newRefreshToken, newHash, err := auth.NewOpaqueToken()
+	if err != nil {
+		log.Printf("Error generating refresh token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not refresh session"})
+		return
+	}
+
+	result, err := db.Exec(`
+        UPDATE sessions
+        SET refresh_token_hash = ?, expires_at = ?, last_used_at = CURRENT_TIMESTAMP
+        WHERE id = ? AND refresh_token_hash = ? AND revoked_at IS NULL`,
+		newHash, time.Now().Add(refreshTTL), sessionID, oldHash)
+	if err != nil {
+		log.Printf("Error rotating refresh token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not refresh session"})
+		return
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+
+	token, tokenExpiresAt, err := tokens.Sign(userID, sessionID)
+	if err != nil {
+		log.Printf("Error signing token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, sessionTokens{
+		Token:        token,
+		ExpiresAt:    tokenExpiresAt,
+		RefreshToken: newRefreshToken,
+	})
+}
+
+func logout(c *gin.Context) {
+	userID := getUserID(c)
+	sessionID := getSessionID(c)
+
+	_, err := db.Exec(`
+        UPDATE sessions
+        SET revoked_at = CURRENT_TIMESTAMP
+        WHERE id = ? AND user_id = ? AND revoked_at IS NULL`,
+		sessionID, userID)
+	if err != nil {
+		log.Printf("Error revoking session: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not log out"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+func logoutAll(c *gin.Context) {
+	userID := getUserID(c)
+
+	if err := revokeUserSessions(db, userID); err != nil {
+		log.Printf("Error revoking sessions: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not log out"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out from all sessions"})
+}
+
+// checkPasswordPolicy връща false и отговаря с нарушените правила, ако паролата не е допустима
+func checkPasswordPolicy(c *gin.Context, password, username string) bool {
+	violations := passwordPolicy.Validate(password, username)
+	if len(violations) == 0 {
+		return true
+	}
+
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error":      "Password does not meet requirements",
+		"violations": violations,
+	})
+	return false
+}
+
+func CheckPasswordHash(password, storedHash string) bool {
+	// Debug информация
+	log.Printf("Checking password: %s", password)
+	log.Printf("Against stored hash: %s", storedHash)
+	log.Printf("Password length: %d", len(password))
+	log.Printf("Stored hash length: %d", len(storedHash))
+
+	// Проверка на хеша
+	err := bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(password))
+	if err != nil {
+		log.Printf("Password check failed: %v", err)
+		return false
+	}
+
+	return true
+}
+
+func addWeight(c *gin.Context) {
+	var input models.WeightRecordInput
+	if err := c.BindJSON(&input); err != nil {
+		log.Printf("Error binding JSON: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := getUserID(c)
+
+	confirmed := input.Confirm || c.Query("confirm") == "true"
+	record, err := newWeightRecord(userID, input, confirmed)
+	if err != nil {
+		respondWeightError(c, err, "Could not save weight record")
+		return
+	}
+
+	if err := insertWeightRecord(&record); err != nil {
+		log.Printf("Error saving weight record: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not save weight record"})
+		return
+	}
+
+	records := []models.WeightRecord{record}
+	if err := presentWeightRecords(userID, records); err != nil {
+		log.Printf("Error fetching user data: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, records[0])
+}
+
+// inputError е грешка във входните данни, която се връща на клиента с 400
+type inputError struct {
+	err error
+}
+
+func (e *inputError) Error() string {
+	return e.err.Error()
+}
+
+// respondWeightError връща 400 за грешки във входа и 500 с message за всичко друго
+func respondWeightError(c *gin.Context, err error, message string) {
+	var invalid *inputError
+	if errors.As(err, &invalid) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": invalid.Error()})
+		return
+	}
+	log.Printf("%s: %v", message, err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+}
+
+// newWeightRecord преобразува входа в SI, валидира го и проверява за рязко отклонение
+func newWeightRecord(userID int, input models.WeightRecordInput, confirmed bool) (models.WeightRecord, error) {
+	record := models.WeightRecord{UserID: userID}
+
+	weightUnit, heightUnit, err := getUnitPreferences(userID)
+	if err != nil {
+		return record, err
+	}
+	if input.Unit == "" {
+		input.Unit = weightUnit
+	}
+	record.Weight, err = models.ToKilograms(input.Weight, input.Unit)
+	if err != nil {
+		return record, &inputError{err}
+	}
+
+	if err := input.Measurements.ToSI(input.Unit, heightUnit); err != nil {
+		return record, &inputError{err}
+	}
+	if err := input.Measurements.Validate(record.Weight); err != nil {
+		return record, &inputError{err}
+	}
+	if !input.Measurements.IsEmpty() {
+		record.Measurements = input.Measurements
+	}
+
+	createdAt, err := time.Parse(time.RFC3339, input.CreatedAt)
+	if err != nil {
+		return record, &inputError{errors.New("Invalid date format")}
+	}
+	record.CreatedAt = createdAt.UTC()
+
+	if err := models.ValidateWeightRecord(record.Weight, record.CreatedAt, time.Now()); err != nil {
+		return record, &inputError{err}
+	}
+
+	record.IsOutlier, err = isUnconfirmedOutlier(userID, 0, record.Weight, record.CreatedAt, confirmed)
+	return record, err
+}
+
+// applyWeightPatch прилага промяната към record в SI и валидира резултата.
+// При replaceMeasurements измерванията се заменят изцяло, иначе се променят само зададените.
+func applyWeightPatch(record *models.WeightRecord, patch models.WeightRecordPatch, replaceMeasurements, confirmed bool) error {
+	weightUnit, heightUnit, err := getUnitPreferences(record.UserID)
+	if err != nil {
+		return err
+	}
+	if patch.Unit == "" {
+		patch.Unit = weightUnit
+	}
+
+	if err := patch.Measurements.ToSI(patch.Unit, heightUnit); err != nil {
+		return &inputError{err}
+	}
+	if replaceMeasurements || record.Measurements == nil {
+		record.Measurements = patch.Measurements
+	} else {
+		record.Measurements.Merge(patch.Measurements)
+	}
+
+	if patch.Weight != nil {
+		record.Weight, err = models.ToKilograms(*patch.Weight, patch.Unit)
+		if err != nil {
+			return &inputError{err}
+		}
+	}
+	if patch.CreatedAt != nil {
+		createdAt, err := time.Parse(time.RFC3339, *patch.CreatedAt)
+		if err != nil {
+			return &inputError{errors.New("Invalid date format")}
+		}
+		record.CreatedAt = createdAt.UTC()
+	}
+
+	if err := models.ValidateWeightRecord(record.Weight, record.CreatedAt, time.Now()); err != nil {
+		return &inputError{err}
+	}
+	if err := record.Measurements.Validate(record.Weight); err != nil {
+		return &inputError{err}
+	}
+
+	// Отклонението се преценява отново, когато се промени теглото или датата
+	if patch.Weight != nil || patch.CreatedAt != nil || confirmed {
+		record.IsOutlier, err = isUnconfirmedOutlier(record.UserID, record.ID, record.Weight, record.CreatedAt, confirmed)
+	}
+	return err
+}
+
+// loadWeightRecord зарежда неизтрит запис заедно с измерванията му
+func loadWeightRecord(id interface{}) (models.WeightRecord, error) {
+	return scanWeightRecord(db.QueryRow(`
+        SELECT `+weightRecordColumns+`
+        FROM weight_records
+        LEFT JOIN body_measurements ON body_measurements.weight_record_id = weight_records.id
+        WHERE id = ? AND deleted_at IS NULL`, id))
+}
+
+// insertWeightRecord записва нов запис заедно с измерванията му
+func insertWeightRecord(record *models.WeightRecord) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(`
+        INSERT INTO weight_records (user_id, weight, is_outlier, created_at, client_id)
+        VALUES (?, ?, ?, ?, NULLIF(?, ''))`,
+		record.UserID, record.Weight, record.IsOutlier, record.CreatedAt, record.ClientID)
+	if err == nil {
+		id, _ := result.LastInsertId()
+		record.ID = int(id)
+		err = saveMeasurements(tx, record.ID, record.Measurements)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	record.UpdatedAt = time.Now()
+	return nil
+}
+
+// updateWeightRecord записва промените по съществуващ запис и обновява updatedAt
+func updateWeightRecord(record *models.WeightRecord) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+        UPDATE weight_records
+        SET weight = ?, is_outlier = ?, created_at = ?, updated_at = CURRENT_TIMESTAMP
+        WHERE id = ? AND user_id = ?`,
+		record.Weight, record.IsOutlier, record.CreatedAt, record.ID, record.UserID)
+	if err == nil {
+		err = saveMeasurements(tx, record.ID, record.Measurements)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return db.QueryRow("SELECT created_at, updated_at FROM weight_records WHERE id = ?", record.ID).
+		Scan(&record.CreatedAt, &record.UpdatedAt)
+}
+
+func getWeightStats(c *gin.Context) {
+	userID := getUserID(c)
+
+	loc, err := getUserLocation(userID)
+	if err != nil {
+		log.Printf("Error fetching user timezone: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	from, to, err := parseTimeRange(c, loc)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	trendOptions, err := parseTrendOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	stats, err := computeWeightStats(userID, from, to, loc)
+	if err != nil {
+		log.Printf("Error computing weight stats: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch weight records"})
+		return
+	}
+
+	// Историята се връща по подразбиране за съвместимост; клиентите, които
+	// ползват /weight/history, могат да я изключат с history=false. Трендът се
+	// смята върху целия период, затова без история се смята само при изрично
+	// подадени trend, smoothing или window.
+	includeHistory := c.Query("history") != "false"
+	if includeHistory || trendRequested(c) {
+		history, _, err := queryWeightHistory(userID, from, to, nil, 0, true)
+		if err != nil {
+			log.Printf("Error fetching weight history: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch weight records"})
+			return
+		}
+
+		// Историята е от най-новия към най-стария, а трендът се смята в хронологичен ред
+		reverseWeightRecords(history)
+		stats.ApplyTrend(history, trendOptions)
+		reverseWeightRecords(history)
+
+		if includeHistory {
+			for i := range history {
+				history[i].Measurements.Derive(history[i].Weight, stats.Height)
+			}
+			stats.History = history
+		}
+	}
+
+	// Прогнозата не е задължителна част от статистиката
+	stats.Projection, err = computeWeightProjection(userID, models.DefaultProjectionWindow, time.Now())
+	if err != nil && err != models.ErrNotEnoughData {
+		log.Printf("Error computing weight projection: %v", err)
+	}
+
+	weightUnit, heightUnit, err := getUnitPreferences(userID)
+	if err != nil {
+		log.Printf("Error fetching unit preferences: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	stats.ConvertTo(weightUnit, heightUnit)
+
+	c.JSON(http.StatusOK, stats)
+}
+
+func getWeightHistory(c *gin.Context) {
+	userID := getUserID(c)
+
+	loc, err := getUserLocation(userID)
+	if err != nil {
+		log.Printf("Error fetching user timezone: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	from, to, err := parseTimeRange(c, loc)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 || limit > 500 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 500"})
+		return
+	}
+
+	var after *weightCursor
+	if raw := c.Query("cursor"); raw != "" {
+		createdAt, id, err := models.DecodeCursor(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		after = &weightCursor{createdAt: createdAt, id: id}
+	}
+
+	records, hasMore, err := queryWeightHistory(userID, from, to, after, limit, true)
+	if err != nil {
+		log.Printf("Error fetching weight history: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch weight records"})
+		return
+	}
+
+	page := models.WeightHistoryPage{Records: records}
+	if page.Records == nil {
+		page.Records = make([]models.WeightRecord, 0)
+	}
+	if hasMore {
+		last := records[len(records)-1]
+		page.NextCursor = models.EncodeCursor(last.CreatedAt, last.ID)
+	}
+	if err := presentWeightRecords(userID, page.Records); err != nil {
+		log.Printf("Error fetching user data: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
+}
+
+// dailyWeightExpressions избират каноничното тегло на деня от колоните на ranked в dailyWeightsCTE
+var dailyWeightExpressions = map[string]string{
+	models.DailyPolicyFirst:   "MAX(first_weight)",
+	models.DailyPolicyLast:    "MAX(last_weight)",
+	models.DailyPolicyMin:     "MIN(weight)",
+	models.DailyPolicyAverage: "AVG(weight)",
+}
+
+// getDailyPreferences връща зоната и правилото за каноничното тегло на деня
+func getDailyPreferences(userID int) (*time.Location, string, error) {
+	var timezone, policy string
+	err := db.QueryRow("SELECT timezone, daily_policy FROM users WHERE id = ?", userID).Scan(&timezone, &policy)
+	if err != nil {
+		return nil, "", err
+	}
+	loc, err := models.LoadTimezone(timezone)
+	return loc, policy, err
+}
+
+// dailyWeightsCTE връща WITH клауза с daily_weights (day, weight, record_count) - по един
+// ред за всеки локален ден в периода с каноничното тегло според policy. Отклоненията и
+// изтритите записи не участват.
+func dailyWeightsCTE(userID int, policy string, loc *time.Location, from, to *time.Time) (string, []interface{}) {
+	// CONVERT_TZ с име на зона изисква заредени таблици за зоните; migrations.Run
+	// спира стартирането, ако ги няма
+	expression, ok := dailyWeightExpressions[policy]
+	if !ok {
+		expression = dailyWeightExpressions[models.DefaultDailyPolicy]
+	}
+
+	rangeClause, rangeArgs := weightRangeFilter(from, to)
+	args := append([]interface{}{loc.String(), userID}, rangeArgs...)
+
+	return `
+        WITH local_records AS (
+            SELECT id, weight, created_at,
+                   DATE(CONVERT_TZ(created_at, '+00:00', ?)) AS day
+            FROM weight_records
+            WHERE user_id = ? AND is_outlier = FALSE AND deleted_at IS NULL` + rangeClause + `
+        ), daily_weights AS (
+            SELECT day, ` + expression + ` AS weight, COUNT(*) AS record_count
+            FROM (
+                SELECT day, weight,
+                       FIRST_VALUE(weight) OVER (PARTITION BY day ORDER BY created_at ASC, id ASC) AS first_weight,
+                       FIRST_VALUE(weight) OVER (PARTITION BY day ORDER BY created_at DESC, id DESC) AS last_weight
+                FROM local_records
+            ) ranked
+            GROUP BY day
+        )`, args
+}
+
+// queryDailyWeights връща каноничните тегла за дните в периода - от най-стария ден
+// или при newestFirst от най-новия. При limit > 0 връща най-много limit дни.
+func queryDailyWeights(userID int, policy string, loc *time.Location, from, to *time.Time, newestFirst bool, limit int) ([]models.DailyWeight, error) {
+	cte, args := dailyWeightsCTE(userID, policy, loc, from, to)
+	query := cte + `
+        SELECT day, weight, record_count
+        FROM daily_weights
+        ORDER BY day`
+	if newestFirst {
+		query += " DESC"
+	}
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var days []models.DailyWeight
+	for rows.Next() {
+		var day time.Time
+		var daily models.DailyWeight
+		if err := rows.Scan(&day, &daily.Weight, &daily.Count); err != nil {
+			return nil, err
+		}
+		// DATE идва като полунощ UTC - превръщаме го в полунощ в зоната на потребителя
+		daily.Start, _ = models.CalendarDay(day, loc)
+		days = append(days, daily)
+	}
+	return days, rows.Err()
+}
+
+// bucketExpressions връщат началото на периода като DATE от локалния ден day
+var bucketExpressions = map[string]string{
+	models.BucketDay:   "day",
+	models.BucketWeek:  "DATE_SUB(day, INTERVAL WEEKDAY(day) DAY)",
+	models.BucketMonth: "DATE(DATE_FORMAT(day, '%Y-%m-01'))",
+}
+
+// getWeightAggregate връща min/max/средно/първо/последно тегло и броя записи за
+// всеки ден, седмица или месец. Групирането е в SQL по локалното време на потребителя
+// върху каноничното тегло на всеки ден.
+func getWeightAggregate(c *gin.Context) {
+	userID := getUserID(c)
+
+	bucket := c.DefaultQuery("bucket", models.BucketDay)
+	if !models.IsValidBucket(bucket) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bucket must be day, week or month"})
+		return
+	}
+
+	weightUnit, _, err := getUnitPreferences(userID)
+	if err != nil {
+		log.Printf("Error fetching user preferences: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	loc, policy, err := getDailyPreferences(userID)
+	if err != nil {
+		log.Printf("Error fetching daily preferences for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	from, to, err := parseTimeRange(c, loc)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Всеки ден участва с каноничното си тегло, така че многото записи в един ден
+	// не изместват средното за седмицата или месеца
+	cte, args := dailyWeightsCTE(userID, policy, loc, from, to)
+	rows, err := db.Query(cte+`
+        , bucketed AS (
+            SELECT day, weight, record_count, `+bucketExpressions[bucket]+` AS bucket
+            FROM daily_weights
+        )
+        SELECT bucket, MIN(weight), MAX(weight), AVG(weight), COUNT(*), SUM(record_count),
+               MAX(first_weight), MAX(last_weight)
+        FROM (
+            SELECT bucket, weight, record_count,
+                   FIRST_VALUE(weight) OVER (PARTITION BY bucket ORDER BY day ASC) AS first_weight,
+                   FIRST_VALUE(weight) OVER (PARTITION BY bucket ORDER BY day DESC) AS last_weight
+            FROM bucketed
+        ) ranked
+        GROUP BY bucket
+        ORDER BY bucket`, args...)
+	if err != nil {
+		log.Printf("Error aggregating weight records: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch weight records"})
+		return
+	}
+	defer rows.Close()
+
+	report := models.WeightAggregateReport{
+		Bucket:      bucket,
+		Timezone:    loc.String(),
+		DailyPolicy: policy,
+		Buckets:     make([]models.WeightAggregate, 0),
+	}
+	for rows.Next() {
+		var day time.Time
+		var aggregate models.WeightAggregate
+		err := rows.Scan(&day, &aggregate.Min, &aggregate.Max, &aggregate.Mean, &aggregate.Days,
+			&aggregate.Count, &aggregate.First, &aggregate.Last)
+		if err != nil {
+			log.Printf("Error scanning weight aggregate: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch weight records"})
+			return
+		}
+		// DATE идва като полунощ UTC - превръщаме го в полунощ в зоната на потребителя
+		aggregate.Start, _ = models.CalendarDay(day, loc)
+		aggregate.End = models.BucketEnd(aggregate.Start, bucket)
+		report.Buckets = append(report.Buckets, aggregate)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error reading weight aggregates: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch weight records"})
+		return
+	}
+
+	report.ConvertTo(weightUnit)
+	c.JSON(http.StatusOK, report)
+}
+
+// getWeightProjection прогнозира кога ще бъде достигнато целевото тегло.
+// window е броят дни назад за регресията, а by - желана крайна дата (YYYY-MM-DD).
+func getWeightProjection(c *gin.Context) {
+	userID := getUserID(c)
+	now := time.Now()
+
+	window, err := strconv.Atoi(c.DefaultQuery("window", strconv.Itoa(models.DefaultProjectionWindow)))
+	if err != nil || window < 1 || window > models.MaxProjectionWindow {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "window must be between 1 and 365 days"})
+		return
+	}
+
+	loc, err := getUserLocation(userID)
+	if err != nil {
+		log.Printf("Error fetching user timezone: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	var deadline *time.Time
+	if value := c.Query("by"); value != "" {
+		date, err := time.ParseInLocation("2006-01-02", value, loc)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid by date: use YYYY-MM-DD"})
+			return
+		}
+		_, end := models.CalendarDay(date, loc)
+		deadline = &end
+	}
+
+	projection, err := computeWeightProjection(userID, window, now)
+	if err == models.ErrNotEnoughData {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Error computing weight projection: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not compute projection"})
+		return
+	}
+	if projection == nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Target weight is not set"})
+		return
+	}
+
+	if deadline != nil {
+		projection.SetDeadline(*deadline, now)
+	}
+
+	weightUnit, _, err := getUnitPreferences(userID)
+	if err != nil {
+		log.Printf("Error fetching unit preferences: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	projection.ConvertTo(weightUnit)
+
+	c.JSON(http.StatusOK, projection)
+}
+
+// computeWeightProjection прави прогноза от записите през последните window дни.
+// Връща nil без грешка, ако потребителят няма целево тегло.
+func computeWeightProjection(userID, window int, now time.Time) (*models.WeightProjection, error) {
+	var target sql.NullFloat64
+	if err := db.QueryRow("SELECT target_weight FROM users WHERE id = ?", userID).Scan(&target); err != nil {
+		return nil, err
+	}
+	if !target.Valid || target.Float64 <= 0 {
+		return nil, nil
+	}
+
+	since := now.AddDate(0, 0, -window)
+	records, _, err := queryWeightHistory(userID, &since, nil, nil, 0, false)
+	if err != nil {
+		return nil, err
+	}
+	reverseWeightRecords(records)
+
+	return models.ProjectWeight(records, target.Float64, window, now)
+}
+
+// parseTimeRange чете from/to от заявката. Приема RFC3339 или дата (YYYY-MM-DD)
+// в зоната на потребителя; при дата to включва целия ден.
+func parseTimeRange(c *gin.Context, loc *time.Location) (*time.Time, *time.Time, error) {
+	parse := func(name string, endOfDay bool) (*time.Time, error) {
+		value := c.Query(name)
+		if value == "" {
+			return nil, nil
+		}
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			return &t, nil
+		}
+		t, err := time.ParseInLocation("2006-01-02", value, loc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: use RFC3339 or YYYY-MM-DD", name)
+		}
+		if endOfDay {
+			t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+		return &t, nil
+	}
+
+	from, err := parse("from", false)
+	if err != nil {
+		return nil, nil, err
+	}
+	to, err := parse("to", true)
+	if err != nil {
+		return nil, nil, err
+	}
+	if from != nil && to != nil && from.After(*to) {
+		return nil, nil, fmt.Errorf("from must be before to")
+	}
+	return from, to, nil
+}
+
+// parseTrendOptions чете trend=ewma|sma, smoothing и window (в дни) от заявката
+func parseTrendOptions(c *gin.Context) (models.TrendOptions, error) {
+	opts := models.DefaultTrendOptions()
+	opts.Method = c.DefaultQuery("trend", opts.Method)
+
+	if value := c.Query("smoothing"); value != "" {
+		smoothing, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return opts, models.ErrInvalidTrendOptions
+		}
+		opts.Smoothing = smoothing
+	}
+	if value := c.Query("window"); value != "" {
+		window, err := strconv.Atoi(value)
+		if err != nil {
+			return opts, models.ErrInvalidTrendOptions
+		}
+		opts.Window = window
+	}
+
+	return opts, opts.Validate()
+}
+
+// trendRequested проверява дали клиентът изрично е поискал тренд
+func trendRequested(c *gin.Context) bool {
+	for _, param := range []string{"trend", "smoothing", "window"} {
+		if _, ok := c.GetQuery(param); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// reverseWeightRecords обръща реда на записите на място
+func reverseWeightRecords(records []models.WeightRecord) {
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+}
+
+type weightCursor struct {
+	createdAt time.Time
+	id        int
+}
+
+// weightRangeFilter връща допълнителното WHERE условие за периода
+func weightRangeFilter(from, to *time.Time) (string, []interface{}) {
+	var clause string
+	var args []interface{}
+	if from != nil {
+		clause += " AND created_at >= ?"
+		args = append(args, *from)
+	}
+	if to != nil {
+		clause += " AND created_at <= ?"
+		args = append(args, *to)
+	}
+	return clause, args
+}
+
+// queryWeightHistory връща записите в периода от най-новия към най-стария.
+// При limit > 0 връща най-много limit записа след курсора и дали има още.
+// Отклоненията се връщат само при includeOutliers.
+func queryWeightHistory(userID int, from, to *time.Time, after *weightCursor, limit int, includeOutliers bool) ([]models.WeightRecord, bool, error) {
+	rangeClause, rangeArgs := weightRangeFilter(from, to)
+	rangeClause += " AND deleted_at IS NULL"
+	if !includeOutliers {
+		rangeClause += " AND is_outlier = FALSE"
+	}
+
+	query := `
+		SELECT ` + weightRecordColumns + `
+		FROM weight_records
+		LEFT JOIN body_measurements ON body_measurements.weight_record_id = weight_records.id
+		WHERE user_id = ?` + rangeClause
+	args := append([]interface{}{userID}, rangeArgs...)
+
+	if after != nil {
+		query += " AND (created_at < ? OR (created_at = ? AND id < ?))"
+		args = append(args, after.createdAt, after.createdAt, after.id)
+	}
+
+	query += " ORDER BY created_at DESC, id DESC"
+	if limit > 0 {
+		// Взимаме един запис повече, за да разберем дали има следваща страница
+		query += " LIMIT ?"
+		args = append(args, limit+1)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var records []models.WeightRecord
+	for rows.Next() {
+		record, err := scanWeightRecord(rows)
+		if err != nil {
+			return nil, false, err
+		}
+		records = append(records, record)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := false
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+		hasMore = true
+	}
+	return records, hasMore, nil
+}
+
+// isUnconfirmedOutlier проверява дали записът е рязка промяна спрямо тренда от
+// последните дни. Потвърдените записи никога не са отклонения; excludeID е
+// записът, който се редактира.
+func isUnconfirmedOutlier(userID, excludeID int, weight float64, createdAt time.Time, confirmed bool) (bool, error) {
+	if confirmed {
+		return false, nil
+	}
+
+	since := createdAt.AddDate(0, 0, -models.OutlierLookbackDays)
+	before := createdAt.Add(-time.Second)
+	records, _, err := queryWeightHistory(userID, &since, &before, nil, 0, false)
+	if err != nil {
+		return false, err
+	}
+
+	previous := make([]models.WeightRecord, 0, len(records))
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].ID != excludeID {
+			previous = append(previous, records[i])
+		}
+	}
+
+	return models.DetectOutlier(weight, createdAt, previous).IsOutlier, nil
+}
+
+// weightRecordColumns са колоните, които scanWeightRecord очаква, при
+// LEFT JOIN на body_measurements към weight_records
+const weightRecordColumns = `id, user_id, weight, is_outlier, created_at, updated_at,
+		body_fat_percent, muscle_mass, waist, hip, chest, water_percent`
+
+// rowScanner е общото между *sql.Row и *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanWeightRecord(rows rowScanner) (models.WeightRecord, error) {
+	var record models.WeightRecord
+	var values [6]sql.NullFloat64
+	err := rows.Scan(&record.ID, &record.UserID, &record.Weight, &record.IsOutlier, &record.CreatedAt, &record.UpdatedAt,
+		&values[0], &values[1], &values[2], &values[3], &values[4], &values[5])
+	if err != nil {
+		return record, err
+	}
+
+	var measurements models.BodyMeasurements
+	fields := []**float64{
+		&measurements.BodyFatPercent, &measurements.MuscleMass, &measurements.Waist,
+		&measurements.Hip, &measurements.Chest, &measurements.WaterPercent,
+	}
+	for i, value := range values {
+		if value.Valid {
+			v := value.Float64
+			*fields[i] = &v
+		}
+	}
+	if !measurements.IsEmpty() {
+		record.Measurements = &measurements
+	}
+	return record, nil
+}
+
+// saveMeasurements записва или изтрива измерванията към запис
+func saveMeasurements(tx *sql.Tx, recordID int, m *models.BodyMeasurements) error {
+	if m.IsEmpty() {
+		_, err := tx.Exec("DELETE FROM body_measurements WHERE weight_record_id = ?", recordID)
+		return err
+	}
+	_, err := tx.Exec(`
+        INSERT INTO body_measurements
+            (weight_record_id, body_fat_percent, muscle_mass, waist, hip, chest, water_percent)
+        VALUES (?, ?, ?, ?, ?, ?, ?)
+        ON DUPLICATE KEY UPDATE
+            body_fat_percent = VALUES(body_fat_percent), muscle_mass = VALUES(muscle_mass),
+            waist = VALUES(waist), hip = VALUES(hip), chest = VALUES(chest),
+            water_percent = VALUES(water_percent)`,
+		recordID, m.BodyFatPercent, m.MuscleMass, m.Waist, m.Hip, m.Chest, m.WaterPercent)
+	return err
+}
+
+// presentWeightRecords изчислява производните показатели и преобразува
+// записите в единиците на потребителя
+func presentWeightRecords(userID int, records []models.WeightRecord) error {
+	var height float64
+	var weightUnit, heightUnit string
+	err := db.QueryRow("SELECT height, weight_unit, height_unit FROM users WHERE id = ?", userID).
+		Scan(&height, &weightUnit, &heightUnit)
+	if err != nil {
+		return err
+	}
+	for i := range records {
+		records[i].Measurements.Derive(records[i].Weight, height)
+		records[i].ConvertTo(weightUnit, heightUnit)
+	}
+	return nil
+}
+
+// computeWeightStats изчислява статистиката за периода само от крайните дни,
+// без да зарежда цялата история. Всеки ден участва с каноничното си тегло според
+// правилото на потребителя, а дневният прогрес сравнява последния ден с предишния
+// ден със записи в зоната на потребителя.
+func computeWeightStats(userID int, from, to *time.Time, loc *time.Location) (models.WeightStats, error) {
+	stats := models.WeightStats{From: from, To: to}
+
+	// Вземаме височината на потребителя
+	err := db.QueryRow("SELECT height, daily_policy FROM users WHERE id = ?", userID).
+		Scan(&stats.Height, &stats.DailyPolicy)
+	if err != nil {
+		return stats, err
+	}
+
+	rangeClause, rangeArgs := weightRangeFilter(from, to)
+	rangeClause += " AND is_outlier = FALSE AND deleted_at IS NULL"
+	args := append([]interface{}{userID}, rangeArgs...)
+
+	err = db.QueryRow(`
+		SELECT COUNT(*)
+		FROM weight_records
+		WHERE user_id = ?`+rangeClause, args...).Scan(&stats.RecordCount)
+	if err != nil || stats.RecordCount == 0 {
+		return stats, err
+	}
+
+	first, err := queryDailyWeights(userID, stats.DailyPolicy, loc, from, to, false, 1)
+	if err != nil {
+		return stats, err
+	}
+	latest, err := queryDailyWeights(userID, stats.DailyPolicy, loc, from, to, true, 2)
+	if err != nil {
+		return stats, err
+	}
+	if len(first) == 0 || len(latest) == 0 {
+		return stats, nil
+	}
+
+	stats.InitialWeight = first[0].Weight
+	stats.CurrentWeight = latest[0].Weight
+	stats.TotalProgress = models.CalculateProgress(stats.InitialWeight, stats.CurrentWeight)
+	stats.BMI = models.CalculateBMI(stats.CurrentWeight, stats.Height)
+	if len(latest) > 1 {
+		stats.PreviousWeight = latest[1].Weight
+		stats.DailyProgress = models.CalculateProgress(stats.PreviousWeight, stats.CurrentWeight)
+	}
+
+	// Измерванията са от последния запис, а производните показатели - спрямо каноничното тегло
+	record, _, err := queryWeightHistory(userID, from, to, nil, 1, false)
+	if err != nil {
+		return stats, err
+	}
+	if len(record) > 0 {
+		stats.Measurements = record[0].Measurements
+		stats.Measurements.Derive(stats.CurrentWeight, stats.Height)
+	}
+
+	return stats, nil
+}
+
+func authMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if token == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "No token provided"})
+			c.Abort()
+			return
+		}
+
+		// Проверяваме подписа и срока на токена
+		claims, err := tokens.Parse(token)
+		if err != nil {
+			if err == auth.ErrExpiredToken {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Token expired"})
+			} else {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			}
+			c.Abort()
+			return
+		}
+
+		// Проверяваме дали сесията не е прекратена и акаунтът е активен
+		var role string
+		var disabled bool
+		err = db.QueryRow(`
+			SELECT u.role, u.disabled_at IS NOT NULL
+			FROM sessions s
+			JOIN users u ON u.id = s.user_id
+			WHERE s.id = ? AND s.user_id = ? AND s.revoked_at IS NULL`,
+			claims.SessionID, claims.UserID).Scan(&role, &disabled)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Session revoked"})
+			} else {
+				log.Printf("Error checking session: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			}
+			c.Abort()
+			return
+		}
+		if disabled {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Account disabled"})
+			c.Abort()
+			return
+		}
+
+		// Запазваме ID-то и ролята в контекста
+		c.Set("userID", claims.UserID)
+		c.Set("sessionID", claims.SessionID)
+		c.Set("role", role)
+		c.Next()
+	}
+}
+
+// capturingWriter запазва копие от отговора, за да може да се повтори
+type capturingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *capturingWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *capturingWriter) WriteString(data string) (int, error) {
+	w.body.WriteString(data)
+	return w.ResponseWriter.WriteString(data)
+}
+
+// idempotencyMiddleware пази отговорите на промените, изпратени с Idempotency-Key.
+// Повторна заявка със същия ключ получава първоначалния отговор, вместо да се
+// изпълни отново. Ключовете са за потребител и важат idempotencyKeyTTL.
+func idempotencyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		if key == "" || c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead ||
+			c.Request.Method == http.MethodOptions {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key is too long"})
+			c.Abort()
+			return
+		}
+
+		userID := getUserID(c)
+
+		// Тялото участва в отпечатъка, за да хванем ключ, използван за друга заявка
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxImportSize))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body is too large"})
+			} else {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Could not read request body"})
+			}
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		fingerprint := sha256.New()
+		fingerprint.Write([]byte(c.Request.Method + " " + c.Request.URL.RequestURI() + "\n"))
+		fingerprint.Write(body)
+		requestHash := hex.EncodeToString(fingerprint.Sum(nil))
+
+		_, err = db.Exec("DELETE FROM idempotency_keys WHERE user_id = ? AND idempotency_key = ? AND created_at < ?",
+			userID, key, time.Now().Add(-idempotencyKeyTTL))
+		if err != nil {
+			log.Printf("Error expiring idempotency key: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			c.Abort()
+			return
+		}
+
+		// Записваме ключа преди изпълнението, за да не минат две еднакви заявки едновременно
+		result, err := db.Exec(`
+            INSERT IGNORE INTO idempotency_keys (user_id, idempotency_key, request_hash)
+            VALUES (?, ?, ?)`, userID, key, requestHash)
+		if err != nil {
+			log.Printf("Error storing idempotency key: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			c.Abort()
+			return
+		}
+
+		if inserted, _ := result.RowsAffected(); inserted == 0 {
+			replayIdempotentResponse(c, userID, key, requestHash)
+			c.Abort()
+			return
+		}
+
+		writer := &capturingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+
+		// При сървърна грешка или panic в handler-а ключът се освобождава, за да може
+		// заявката да се опита отново, вместо да остане "в изпълнение" до изтичането си
+		completed := false
+		defer func() {
+			var err error
+			status := writer.Status()
+			if !completed || status >= http.StatusInternalServerError {
+				_, err = db.Exec("DELETE FROM idempotency_keys WHERE user_id = ? AND idempotency_key = ?", userID, key)
+			} else {
+				_, err = db.Exec(`
+                    UPDATE idempotency_keys
+                    SET status_code = ?, content_type = ?, response_body = ?
+                    WHERE user_id = ? AND idempotency_key = ?`,
+					status, writer.Header().Get("Content-Type"), writer.body.Bytes(), userID, key)
+			}
+			if err != nil {
+				log.Printf("Error saving idempotent response: %v", err)
+			}
+		}()
+
+		c.Next()
+		completed = true
+	}
+}
+
+// purgeExpiredIdempotencyKeys трие изтеклите ключове на всички потребители през interval.
+// Middleware-ът трие само ключа, който се използва повторно, и без това таблицата би растяла.
+func purgeExpiredIdempotencyKeys(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		result, err := db.Exec("DELETE FROM idempotency_keys WHERE created_at < ?", time.Now().Add(-idempotencyKeyTTL))
+		if err != nil {
+			log.Printf("Error purging idempotency keys: %v", err)
+			continue
+		}
+		if rows, _ := result.RowsAffected(); rows > 0 {
+			log.Printf("Purged %d expired idempotency keys", rows)
+		}
+	}
+}
+
+func replayIdempotentResponse(c *gin.Context, userID int, key, requestHash string) {
+	var storedHash string
+	var status sql.NullInt64
+	var contentType sql.NullString
+	var body []byte
+	err := db.QueryRow(`
+        SELECT request_hash, status_code, content_type, response_body
+        FROM idempotency_keys
+        WHERE user_id = ? AND idempotency_key = ?`, userID, key).
+		Scan(&storedHash, &status, &contentType, &body)
+	if err != nil {
+		log.Printf("Error fetching idempotency key: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	switch {
+	case storedHash != requestHash:
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was already used for a different request"})
+	case !status.Valid:
+		c.JSON(http.StatusConflict, gin.H{"error": "A request with this Idempotency-Key is still in progress"})
+	default:
+		c.Header("Idempotent-Replayed", "true")
+		c.Data(int(status.Int64), contentType.String, body)
+	}
+}
+
+func getUserID(c *gin.Context) int {
+	// Взимаме ID-то от контекста
+	userID, exists := c.Get("userID")
+	if !exists {
+		return 0
+	}
+	return userID.(int)
+}
+
+func getUserRole(c *gin.Context) string {
+	role, exists := c.Get("role")
+	if !exists {
+		return ""
+	}
+	return role.(string)
+}
+
+// requireRole пропуска само потребители с дадената роля или по-висока.
+// Използва се след authMiddleware.
+func requireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !models.HasRole(getUserRole(c), role) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+func getSessionID(c *gin.Context) int64 {
+	sessionID, exists := c.Get("sessionID")
+	if !exists {
+		return 0
+	}
+	return sessionID.(int64)
+}
+
+func getUserSettings(c *gin.Context) {
+	userID := getUserID(c)
+
+	var user models.User
+	err := db.QueryRow(`
+        SELECT u.id, u.username, COALESCE(u.first_name, ''), COALESCE(u.last_name, ''), COALESCE(u.age, 0),
+               u.height, COALESCE(u.gender, ''), COALESCE(u.email, ''), COALESCE(u.target_weight, 0),
+               COALESCE(us.is_visible, false), u.email_verified_at IS NOT NULL, u.weight_unit, u.height_unit,
+               u.timezone, u.daily_policy
+        FROM users u
+        LEFT JOIN user_settings us ON u.id = us.user_id
+        WHERE u.id = ?`, userID).Scan(
+		&user.ID, &user.Username, &user.FirstName, &user.LastName,
+		&user.Age, &user.Height, &user.Gender, &user.Email, &user.Target, &user.IsVisible,
+		&user.EmailVerified, &user.WeightUnit, &user.HeightUnit, &user.Timezone, &user.DailyPolicy)
+
+	if err != nil {
+		log.Printf("Error fetching user settings: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch user settings"})
+		return
+	}
+	user.ConvertTo(user.WeightUnit, user.HeightUnit)
+
+	c.JSON(http.StatusOK, user)
+}
+
+func updateUserSettings(c *gin.Context) {
+	userID := getUserID(c)
+	var settings models.User
+
+	if err := c.BindJSON(&settings); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	if settings.Email != "" && !isValidEmail(settings.Email) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email address"})
+		return
+	}
+
+	var currentEmail sql.NullString
+	var weightUnit, heightUnit, timezone, dailyPolicy string
+	err := db.QueryRow("SELECT email, weight_unit, height_unit, timezone, daily_policy FROM users WHERE id = ?", userID).
+		Scan(&currentEmail, &weightUnit, &heightUnit, &timezone, &dailyPolicy)
+	if err != nil {
+		log.Printf("Error fetching user email: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update settings"})
+		return
+	}
+	emailChanged := settings.Email != currentEmail.String
+
+	// Без изрично зададени единици стойностите са в досегашните единици на потребителя
+	if settings.WeightUnit == "" {
+		settings.WeightUnit = weightUnit
+	}
+	if settings.HeightUnit == "" {
+		settings.HeightUnit = heightUnit
+	}
+	if !resolveUnitPreferences(c, &settings) {
+		return
+	}
+
+	if settings.Timezone == "" {
+		settings.Timezone = timezone
+	}
+	if _, err := models.LoadTimezone(settings.Timezone); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if settings.DailyPolicy == "" {
+		settings.DailyPolicy = dailyPolicy
+	}
+	if !models.IsValidDailyPolicy(settings.DailyPolicy) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": models.ErrInvalidDailyPolicy.Error()})
+		return
+	}
+
+	// При смяна на имейла потвърждението се губи
+	_, err = db.Exec(`
+        UPDATE users 
+        SET first_name = ?, last_name = ?, age = ?, height = ?, 
+            gender = ?, email = NULLIF(?, ''), target_weight = ?, updated_at = CURRENT_TIMESTAMP,
+            email_verified_at = IF(?, NULL, email_verified_at),
+            weight_unit = ?, height_unit = ?, timezone = ?, daily_policy = ?
+        WHERE id = ?`,
+		settings.FirstName, settings.LastName, settings.Age, settings.Height,
+		settings.Gender, settings.Email, settings.Target, emailChanged,
+		settings.WeightUnit, settings.HeightUnit, settings.Timezone, settings.DailyPolicy, userID)
+
+	if err != nil {
+		log.Printf("Error updating user settings: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update settings"})
+		return
+	}
+
+	if emailChanged && settings.Email != "" {
+		if err := sendEmailVerification(userID, settings.Email); err != nil {
+			log.Printf("Error sending verification email to user %d: %v", userID, err)
+			c.JSON(http.StatusOK, gin.H{"message": "Settings updated, but the verification email could not be sent"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Settings updated successfully, please verify your new email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Settings updated successfully"})
+}
+
+// getUnitPreferences връща мерните единици, в които потребителят вижда теглото и височината
+func getUnitPreferences(userID int) (weightUnit, heightUnit string, err error) {
+	err = db.QueryRow("SELECT weight_unit, height_unit FROM users WHERE id = ?", userID).
+		Scan(&weightUnit, &heightUnit)
+	return weightUnit, heightUnit, err
+}
+
+// getUserLocation връща часовата зона, в която се смятат дните на потребителя
+func getUserLocation(userID int) (*time.Location, error) {
+	var timezone string
+	if err := db.QueryRow("SELECT timezone FROM users WHERE id = ?", userID).Scan(&timezone); err != nil {
+		return nil, err
+	}
+	return models.LoadTimezone(timezone)
+}
+
+// resolveUnitPreferences проверява единиците в user и преобразува височината и
+// целевото тегло към cm и kg. При грешка вече е върнат отговор.
+func resolveUnitPreferences(c *gin.Context, user *models.User) bool {
+	if user.WeightUnit == "" {
+		user.WeightUnit = models.WeightUnitKg
+	}
+	if user.HeightUnit == "" {
+		user.HeightUnit = models.HeightUnitCm
+	}
+	if !models.IsValidWeightUnit(user.WeightUnit) || !models.IsValidHeightUnit(user.HeightUnit) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Weight unit must be kg, lb or st and height unit cm or ftin"})
+		return false
+	}
+
+	// Записваме нормализираните имена, за да пасват на ENUM колоните
+	user.WeightUnit = models.NormalizeUnit(user.WeightUnit)
+	user.HeightUnit = models.NormalizeUnit(user.HeightUnit)
+
+	user.Height, _ = models.ToCentimeters(user.Height, user.HeightUnit)
+	user.Target, _ = models.ToKilograms(user.Target, user.WeightUnit)
+	return true
+}
+
+func isValidEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
+
+// sendEmailVerification създава токен за потвърждение на адреса и го изпраща по пощата
+func sendEmailVerification(userID int, email string) error {
+	token, tokenHash, err := auth.NewOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+        INSERT INTO email_verifications (user_id, email, token_hash, expires_at)
+        VALUES (?, ?, ?, ?)`,
+		userID, email, tokenHash, time.Now().Add(emailVerificationTTL))
+	if err != nil {
+		return err
+	}
+
+	return mailSender.Send(mailer.Message{
+		To:      email,
+		Subject: "Confirm your Weight Challenge email",
+		Body: fmt.Sprintf("Confirm your email address by opening the link below. It expires in %s.\r\n\r\n%s/verify-email?token=%s",
+			emailVerificationTTL, apiURL, token),
+	})
+}
+
+func verifyEmail(c *gin.Context) {
+	token := c.Query("token")
+	if token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Token is required"})
+		return
+	}
+
+	var verificationID, userID int
+	var email string
+	var expiresAt time.Time
+	var usedAt sql.NullTime
+	err := db.QueryRow(`
+        SELECT id, user_id, email, expires_at, used_at
+        FROM email_verifications
+        WHERE token_hash = ?`,
+		auth.HashToken(token)).Scan(&verificationID, &userID, &email, &expiresAt, &usedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired verification token"})
+			return
+		}
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if usedAt.Valid || time.Now().After(expiresAt) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired verification token"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Transaction error"})
+		return
+	}
+
+	_, err = tx.Exec("UPDATE email_verifications SET used_at = CURRENT_TIMESTAMP WHERE id = ?", verificationID)
+	if err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not verify email"})
+		return
+	}
+
+	// Потвърждаваме само ако адресът не е сменен след изпращането на писмото
+	result, err := tx.Exec(`
+        UPDATE users
+        SET email_verified_at = CURRENT_TIMESTAMP
+        WHERE id = ? AND email = ?`,
+		userID, email)
+	if err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not verify email"})
+		return
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		tx.Rollback()
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Email address has changed since the link was sent"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not verify email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email verified successfully"})
+}
+
+func resendEmailVerification(c *gin.Context) {
+	userID := getUserID(c)
+
+	var email sql.NullString
+	var verified bool
+	err := db.QueryRow("SELECT email, email_verified_at IS NOT NULL FROM users WHERE id = ?", userID).Scan(&email, &verified)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch user data"})
+		return
+	}
+
+	if !email.Valid || email.String == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No email address set"})
+		return
+	}
+
+	if verified {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Email is already verified"})
+		return
+	}
+
+	if err := sendEmailVerification(userID, email.String); err != nil {
+		log.Printf("Error sending verification email to user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not send verification email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Verification email sent"})
+}
+
+func verifiedEmailMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !requireVerifiedEmail {
+			c.Next()
+			return
+		}
+
+		var verified bool
+		err := db.QueryRow("SELECT email_verified_at IS NOT NULL FROM users WHERE id = ?", getUserID(c)).Scan(&verified)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch user data"})
+			c.Abort()
+			return
+		}
+
+		if !verified {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Email verification required"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func changePassword(c *gin.Context) {
+	userID := getUserID(c)
+	var req struct {
+		CurrentPassword string `json:"currentPassword"`
+		NewPassword     string `json:"newPassword"`
+	}
+
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	// Проверка на текущата парола
+	var storedHash, username string
+	err := db.QueryRow("SELECT password, username FROM users WHERE id = ?", userID).Scan(&storedHash, &username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not verify current password"})
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(req.CurrentPassword)); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Current password is incorrect"})
+		return
+	}
+
+	if !checkPasswordPolicy(c, req.NewPassword, username) {
+		return
+	}
+
+	// Хеширане и запазване на новата парола
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not process new password"})
+		return
+	}
+
+	// Новата парола, прекратяването на старите сесии и новата сесия за текущото
+	// устройство са в една транзакция - иначе при грешка старите refresh токени остават валидни
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Transaction error"})
+		return
+	}
+
+	_, err = tx.Exec("UPDATE users SET password = ? WHERE id = ?", string(hashedPassword), userID)
+	if err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update password"})
+		return
+	}
+
+	if err := revokeUserSessions(tx, userID); err != nil {
+		tx.Rollback()
+		log.Printf("Error revoking sessions: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not revoke sessions"})
+		return
+	}
+
+	session, err := issueSession(tx, c, userID)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Error creating session: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create session"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error changing password: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update password"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Password changed successfully",
+		"token":        session.Token,
+		"expiresAt":    session.ExpiresAt,
+		"refreshToken": session.RefreshToken,
+	})
+}
+
+func exportUserData(c *gin.Context) {
+	userID := getUserID(c)
+
+	export, err := buildUserExport(userID)
+	if err != nil {
+		log.Printf("Error exporting data for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not export user data"})
+		return
+	}
+
+	filename := fmt.Sprintf("weight-challenge-export-%s", export.ExportedAt.Format("20060102"))
+
+	switch c.DefaultQuery("format", "json") {
+	case "json":
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.json"`, filename))
+		c.JSON(http.StatusOK, export)
+	case "zip":
+		// Всеки раздел е в отделен файл в архива
+		files := []struct {
+			name string
+			data interface{}
+		}{
+			{"profile.json", export.Profile},
+			{"weight_records.json", export.WeightRecords},
+			{"friendships.json", export.Friendships},
+			{"challenges.json", export.Challenges},
+			{"identities.json", export.Identities},
+			{"export.json", export},
+		}
+
+		var buf bytes.Buffer
+		archive := zip.NewWriter(&buf)
+		for _, file := range files {
+			w, err := archive.Create(file.name)
+			if err == nil {
+				encoder := json.NewEncoder(w)
+				encoder.SetIndent("", "  ")
+				err = encoder.Encode(file.data)
+			}
+			if err != nil {
+				log.Printf("Error writing export archive: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not export user data"})
+				return
+			}
+		}
+		if err := archive.Close(); err != nil {
+			log.Printf("Error writing export archive: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not export user data"})
+			return
+		}
+
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, filename))
+		c.Data(http.StatusOK, "application/zip", buf.Bytes())
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported format"})
+	}
+}
+
+// buildUserExport събира профила, историята на теглото, приятелствата и съревнованията на потребителя
+func buildUserExport(userID int) (*models.UserExport, error) {
+	export := &models.UserExport{
+		ExportedAt:    time.Now(),
+		WeightRecords: make([]models.WeightRecord, 0),
+		Friendships:   make([]models.Friendship, 0),
+		Challenges:    make([]models.Challenge, 0),
+		Identities:    make([]models.LinkedIdentity, 0),
+	}
+
+	profile := &export.Profile
+	err := db.QueryRow(`
+        SELECT u.id, u.username, COALESCE(u.first_name, ''), COALESCE(u.last_name, ''), COALESCE(u.age, 0),
+               u.height, COALESCE(u.gender, ''), COALESCE(u.email, ''), COALESCE(u.target_weight, 0),
+               COALESCE(us.is_visible, false), u.email_verified_at IS NOT NULL, u.role
+        FROM users u
+        LEFT JOIN user_settings us ON u.id = us.user_id
+        WHERE u.id = ?`, userID).Scan(
+		&profile.ID, &profile.Username, &profile.FirstName, &profile.LastName, &profile.Age,
+		&profile.Height, &profile.Gender, &profile.Email, &profile.Target,
+		&profile.IsVisible, &profile.EmailVerified, &profile.Role)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+        SELECT `+weightRecordColumns+`
+        FROM weight_records
+        LEFT JOIN body_measurements ON body_measurements.weight_record_id = weight_records.id
+        WHERE user_id = ? AND deleted_at IS NULL
+        ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		record, err := scanWeightRecord(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		export.WeightRecords = append(export.WeightRecords, record)
+	}
+	rows.Close()
+
+	rows, err = db.Query(`
+        SELECT f.id, f.requester_id, f.addressee_id, u.username, f.status, f.created_at, f.updated_at
+        FROM friendships f
+        JOIN users u ON u.id = IF(f.requester_id = ?, f.addressee_id, f.requester_id)
+        WHERE f.requester_id = ? OR f.addressee_id = ?
+        ORDER BY f.created_at`, userID, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var friendship models.Friendship
+		if err := rows.Scan(&friendship.ID, &friendship.RequesterID, &friendship.AddresseeID,
+			&friendship.FriendUsername, &friendship.Status, &friendship.CreatedAt, &friendship.UpdatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		export.Friendships = append(export.Friendships, friendship)
+	}
+	rows.Close()
+
+	rows, err = db.Query(`
+        SELECT c.id, c.creator_id, c.opponent_id, c.start_date, c.end_date, c.status, c.created_at, c.updated_at,
+               creator.username, opponent.username
+        FROM challenges c
+        JOIN users creator ON c.creator_id = creator.id
+        JOIN users opponent ON c.opponent_id = opponent.id
+        WHERE c.creator_id = ? OR c.opponent_id = ?
+        ORDER BY c.created_at`, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var challenge models.Challenge
+		if err := rows.Scan(&challenge.ID, &challenge.CreatorID, &challenge.OpponentID,
+			&challenge.StartDate, &challenge.EndDate, &challenge.Status, &challenge.CreatedAt, &challenge.UpdatedAt,
+			&challenge.CreatorName, &challenge.OpponentName); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		export.Challenges = append(export.Challenges, challenge)
+	}
+	rows.Close()
+
+	// Към съревнованията добавяме само собствените резултати
+	for i := range export.Challenges {
+		var result models.ChallengeResult
+		err := db.QueryRow(`
+            SELECT challenge_id, user_id, initial_weight, COALESCE(final_weight, 0), COALESCE(progress, 0)
+            FROM challenge_results
+            WHERE challenge_id = ? AND user_id = ?`,
+			export.Challenges[i].ID, userID).Scan(
+			&result.ChallengeID, &result.UserID, &result.InitialWeight, &result.FinalWeight, &result.Progress)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		result.Username = profile.Username
+		export.Challenges[i].Results = []models.ChallengeResult{result}
+	}
+
+	rows, err = db.Query(`
+        SELECT provider, COALESCE(email, ''), created_at
+        FROM user_identities
+        WHERE user_id = ?`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var identity models.LinkedIdentity
+		if err := rows.Scan(&identity.Provider, &identity.Email, &identity.CreatedAt); err != nil {
+			return nil, err
+		}
+		export.Identities = append(export.Identities, identity)
+	}
+
+	return export, rows.Err()
+}
+
+func deleteAccount(c *gin.Context) {
+	userID := getUserID(c)
+	var req struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+		return
+	}
+
+	if !confirmAccountDeletion(c, userID, req.Password, req.Code) {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Transaction error"})
+		return
+	}
+
+	// Редът е важен заради външните ключове: първо зависимите таблици, накрая users.
+	// Съревнованията, в които участва потребителят, се изтриват изцяло заедно с
+	// резултатите на противника, защото нямат смисъл без двамата участници.
+	statements := []string{
+		// Другите участници научават за изтритите приятелства и съревнования при синхронизация
+		`INSERT INTO sync_tombstones (user_id, entity, entity_id)
+         SELECT IF(creator_id = ?, opponent_id, creator_id), 'challenge', id
+         FROM challenges WHERE creator_id = ? OR opponent_id = ?`,
+		`INSERT INTO sync_tombstones (user_id, entity, entity_id)
+         SELECT IF(requester_id = ?, addressee_id, requester_id), 'friendship', id
+         FROM friendships WHERE requester_id = ? OR addressee_id = ?`,
+		`DELETE cr FROM challenge_results cr
+         JOIN challenges ch ON ch.id = cr.challenge_id
+         WHERE ch.creator_id = ? OR ch.opponent_id = ?`,
+		"DELETE FROM challenge_results WHERE user_id = ?",
+		"DELETE FROM challenges WHERE creator_id = ? OR opponent_id = ?",
+		"DELETE FROM friendships WHERE requester_id = ? OR addressee_id = ?",
+		`DELETE bm FROM body_measurements bm
+            JOIN weight_records wr ON wr.id = bm.weight_record_id
+            WHERE wr.user_id = ?`,
+		"DELETE FROM weight_records WHERE user_id = ?",
+		"DELETE FROM user_settings WHERE user_id = ?",
+		"DELETE FROM sessions WHERE user_id = ?",
+		"DELETE FROM password_resets WHERE user_id = ?",
+		"DELETE FROM email_verifications WHERE user_id = ?",
+		"DELETE FROM two_factor_challenges WHERE user_id = ?",
+		"DELETE FROM user_identities WHERE user_id = ?",
+		"DELETE FROM idempotency_keys WHERE user_id = ?",
+		"DELETE FROM sync_tombstones WHERE user_id = ?",
+		"DELETE FROM users WHERE id = ?",
+	}
+	for _, statement := range statements {
+		args := make([]interface{}, strings.Count(statement, "?"))
+		for i := range args {
+			args[i] = userID
+		}
+		if _, err := tx.Exec(statement, args...); err != nil {
+			tx.Rollback()
+			log.Printf("Error deleting account %d: %v", userID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete account"})
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error deleting account %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete account"})
+		return
+	}
+
+	log.Printf("Deleted account %d", userID)
+	c.JSON(http.StatusOK, gin.H{"message": "Account deleted"})
+}
+
+// confirmAccountDeletion проверява, че изтриването е поискано от собственика. Паролата
+// винаги е достатъчна. Акаунтите, създадени през OIDC, имат случайна парола, затова
+// при тях се приема и 2FA код, а без 2FA - сесия, започната преди по-малко от reauthWindow.
+// При отказ отговорът вече е изпратен.
+func confirmAccountDeletion(c *gin.Context, userID int, password, code string) bool {
+	var storedHash string
+	var totpSecret sql.NullString
+	var totpEnabled, hasIdentity bool
+	var lastStep int64
+	err := db.QueryRow(`
+        SELECT password, totp_secret, totp_enabled, totp_last_step,
+               EXISTS(SELECT 1 FROM user_identities WHERE user_id = users.id)
+        FROM users WHERE id = ?`, userID).Scan(&storedHash, &totpSecret, &totpEnabled, &lastStep, &hasIdentity)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not verify password"})
+		return false
+	}
+
+	if password != "" {
+		if err := bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(password)); err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Password is incorrect"})
+			return false
+		}
+		return true
+	}
+	if !hasIdentity {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password is required"})
+		return false
+	}
+
+	if totpEnabled {
+		if code == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Password or 2FA code is required"})
+			return false
+		}
+		step, valid := auth.ValidateTOTP(totpSecret.String, code, time.Now(), lastStep)
+		if valid {
+			// Запомняме периода, за да не се приеме същият код повторно
+			result, err := db.Exec("UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?", step, userID, step)
+			if err != nil {
+				log.Printf("Error updating 2FA state: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+				return false
+			}
+			if rows, _ := result.RowsAffected(); rows == 0 {
+				valid = false
+			}
+		}
+		if !valid {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid 2FA code"})
+			return false
+		}
+		return true
+	}
+
+	// Без парола и 2FA потвърждение е скорошен вход през доставчика
+	var recent bool
+	err = db.QueryRow(`
+        SELECT created_at >= NOW() - INTERVAL ? SECOND
+        FROM sessions WHERE id = ? AND user_id = ?`,
+		int(reauthWindow.Seconds()), getSessionID(c), userID).Scan(&recent)
+	if err != nil {
+		log.Printf("Error checking session: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	if !recent {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error":          "Sign in again to confirm account deletion",
+			"reauthenticate": true,
+		})
+		return false
+	}
+	return true
+}
+
+func getVisibleUsers(c *gin.Context) {
+	userID := getUserID(c)
+
+	rows, err := db.Query(`
+        SELECT u.id, u.username, u.height, 
+               COALESCE(
+                   (SELECT ((w1.weight - w2.weight) / w1.weight * 100)
+                    FROM weight_records w1
+                    JOIN weight_records w2 ON w2.user_id = u.id AND w2.deleted_at IS NULL
+                    WHERE w1.user_id = u.id AND w1.deleted_at IS NULL
+                    AND w1.created_at = (SELECT MIN(created_at) FROM weight_records WHERE user_id = u.id AND deleted_at IS NULL)
+                    AND w2.created_at = (SELECT MAX(created_at) FROM weight_records WHERE user_id = u.id AND deleted_at IS NULL)
+                    LIMIT 1
+                   ), 0
+               ) as progress
+        FROM users u
+        JOIN user_settings us ON u.id = us.user_id
+        WHERE us.is_visible = true 
+        AND u.id != ?
+        AND NOT EXISTS (
+            SELECT 1 FROM friendships f
+            WHERE ((f.requester_id = ? AND f.addressee_id = u.id) 
+               OR (f.requester_id = u.id AND f.addressee_id = ?))
+            AND f.status IN ('accepted', 'pending')
+        )`,
+		userID, userID, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch users"})
+		return
+	}
+	defer rows.Close()
+
+	_, heightUnit, err := getUnitPreferences(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch users"})
+		return
+	}
+
+	var users []models.UserProfile
+	for rows.Next() {
+		var user models.UserProfile
+		if err := rows.Scan(&user.ID, &user.Username, &user.Height, &user.Progress); err != nil {
+			continue
+		}
+		user.ConvertTo(heightUnit)
+		users = append(users, user)
+	}
+
+	c.JSON(http.StatusOK, users)
+}
+
+func updateVisibility(c *gin.Context) {
+	userID := getUserID(c)
+	var settings struct {
+		IsVisible bool `json:"isVisible"`
+	}
+
+	if err := c.BindJSON(&settings); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	_, err := db.Exec(`
+        INSERT INTO user_settings (user_id, is_visible) 
+        VALUES (?, ?)
+        ON DUPLICATE KEY UPDATE is_visible = ?`,
+		userID, settings.IsVisible, settings.IsVisible)
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update visibility"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Visibility updated"})
+}
+
+func getFriends(c *gin.Context) {
+	userID := getUserID(c)
+
+	rows, err := db.Query(`
+        SELECT u.id, u.username, u.height, f.status, f.id as friendship_id,
+               COALESCE(
+                   (SELECT ((w1.weight - w2.weight) / w1.weight * 100)
+                    FROM weight_records w1
+                    JOIN weight_records w2 ON w2.user_id = u.id AND w2.deleted_at IS NULL
+                    WHERE w1.user_id = u.id AND w1.deleted_at IS NULL
+                    AND w1.created_at = (SELECT MIN(created_at) FROM weight_records WHERE user_id = u.id AND deleted_at IS NULL)
+                    AND w2.created_at = (SELECT MAX(created_at) FROM weight_records WHERE user_id = u.id AND deleted_at IS NULL)
+                    LIMIT 1
+                   ), 0
+               ) as progress
+        FROM users u
+        JOIN friendships f ON (f.requester_id = u.id OR f.addressee_id = u.id)
+        WHERE (f.requester_id = ? OR f.addressee_id = ?)
+        AND u.id != ?`,
+		userID, userID, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch friends"})
+		return
+	}
+	defer rows.Close()
+
+	_, heightUnit, err := getUnitPreferences(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch friends"})
+		return
+	}
+
+	var friends []struct {
+		models.UserProfile
+		Status       string `json:"status"`
+		FriendshipID int    `json:"friendshipId"`
+	}
+
+	for rows.Next() {
+		var friend struct {
+			models.UserProfile
+			Status       string `json:"status"`
+			FriendshipID int    `json:"friendshipId"`
+		}
+		if err := rows.Scan(&friend.ID, &friend.Username, &friend.Height, &friend.Status, &friend.FriendshipID, &friend.Progress); err != nil {
+			continue
+		}
+		friend.ConvertTo(heightUnit)
+		friends = append(friends, friend)
+	}
+
+	c.JSON(http.StatusOK, friends)
+}
+
+func sendFriendRequest(c *gin.Context) {
+	userID := getUserID(c)
+	friendIDStr := c.Param("userId")
+
+	// Проверяваме дали ID-то не е празно
+	if friendIDStr == "" {
+		log.Printf("Липсващо ID на потребител в заявката")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Не е предоставено ID на потребител"})
+		return
+	}
+
+	// Конвертираме friendID в число
+	friendID, err := strconv.Atoi(friendIDStr)
+	if err != nil {
+		log.Printf("Невалидно ID на потребител: %v (стойност: %s)", err, friendIDStr)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Невалидно ID на потребител"})
+		return
+	}
+
+	// Проверяваме дали потребителят не се опитва да добави себе си
+	if friendID == userID {
+		log.Printf("Потребител %d се опитва да добави себе си за приятел", userID)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Не можете да добавите себе си за приятел"})
+		return
+	}
+
+	// Debug logging
+	log.Printf("Получена заявка за приятелство от потребител %d към потребител %d", userID, friendID)
+
+	// Проверяваме дали потребителят съществува
+	var exists bool
+	err = db.QueryRow(`
+        SELECT EXISTS(
+            SELECT 1 FROM users 
+            WHERE id = ?
+        )`, friendID).Scan(&exists)
+
+	if err != nil {
+		log.Printf("Грешка при проверка на потребителя: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Възникна грешка при проверка на потребителя"})
+		return
+	}
+
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Потребителят не е намерен"})
+		return
+	}
+
+	// Проверяваме дали вече има активна или изчакваща заявка между тези потребители
+	err = db.QueryRow(`
+        SELECT EXISTS(
+            SELECT 1 FROM friendships 
+            WHERE ((requester_id = ? AND addressee_id = ?) 
+               OR (requester_id = ? AND addressee_id = ?))
+            AND status IN ('pending', 'accepted')
+        )`, userID, friendID, friendID, userID).Scan(&exists)
+
+	if err != nil {
+		log.Printf("Грешка при проверка за съществуваща заявка: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Възникна грешка при проверка за съществуваща заявка"})
+		return
+	}
+
+	if exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Вече съществува активна заявка за приятелство между тези потребители"})
+		return
+	}
+
+	// Първо проверяваме дали има отхвърлена заявка и я актуализираме
+	result, err := db.Exec(`
+        UPDATE friendships 
+        SET status = 'pending', requester_id = ?, addressee_id = ?, updated_at = CURRENT_TIMESTAMP
+        WHERE (requester_id = ? AND addressee_id = ?) 
+           OR (requester_id = ? AND addressee_id = ?)
+           AND status = 'rejected'`,
+        userID, friendID, userID, friendID, friendID, userID)
+
+	if err != nil {
+		log.Printf("Грешка при обновяване на съществуваща заявка: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Възникна грешка при обновяване на заявката"})
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	
+	// Ако няма отхвърлена заявка за обновяване, създаваме нова
+	if rowsAffected == 0 {
+		_, err = db.Exec(`
+            INSERT INTO friendships (requester_id, addressee_id) 
+            VALUES (?, ?)`,
+            userID, friendID)
+
+		if err != nil {
+			log.Printf("Грешка при създаване на нова заявка за приятелство: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Възникна грешка при създаване на заявката"})
+			return
+		}
+	}
+
+	log.Printf("Успешно създадена/обновена заявка за приятелство от %d към %d", userID, friendID)
+	c.JSON(http.StatusOK, gin.H{"message": "Заявката за приятелство е изпратена успешно"})
+}
+
+func acceptFriendRequest(c *gin.Context) {
+	userID := getUserID(c)
+	friendshipID := c.Param("friendshipId")
+
+	// Проверяваме дали приятелството съществува
+	var exists bool
+	err := db.QueryRow(`
+        SELECT EXISTS(
+            SELECT 1 FROM friendships 
+            WHERE id = ?
+        )`, friendshipID).Scan(&exists)
+
+	if err != nil {
+		log.Printf("Грешка при проверка на приятелството: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Възникна грешка при проверка на приятелството"})
+		return
+	}
+
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Приятелството не съществува"})
+		return
+	}
+
+	// Проверяваме дали потребителят има право да приеме това приятелство
+	var isAddressee bool
+	err = db.QueryRow(`
+        SELECT EXISTS(
+            SELECT 1 FROM friendships 
+            WHERE id = ? AND addressee_id = ? AND status = 'pending'
+        )`, friendshipID, userID).Scan(&isAddressee)
+
+	if err != nil {
+		log.Printf("Грешка при проверка на правата: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Възникна грешка при проверка на правата"})
+		return
+	}
+
+	if !isAddressee {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Нямате право да приемете това приятелство или то вече е обработено"})
+		return
+	}
+
+	result, err := db.Exec(`
+        UPDATE friendships 
+        SET status = 'accepted' 
+        WHERE id = ? AND addressee_id = ? AND status = 'pending'`,
+        friendshipID, userID)
+
+	if err != nil {
+		log.Printf("Грешка при приемане на приятелството: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Възникна грешка при приемане на приятелството"})
+		return
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Приятелството не може да бъде прието"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Приятелството е прието успешно"})
+}
+
+func rejectFriendRequest(c *gin.Context) {
+	userID := getUserID(c)
+	friendshipID := c.Param("friendshipId")
+
+	result, err := db.Exec(`
+        UPDATE friendships 
+        SET status = 'rejected' 
+        WHERE id = ? AND addressee_id = ?`,
+		friendshipID, userID)
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not reject friend request"})
+		return
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Friend request rejected"})
+}
+
+func createChallenge(c *gin.Context) {
+	userID := getUserID(c)
+	var challenge models.Challenge
+
+	if err := c.BindJSON(&challenge); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	// Проверяваме дали са приятели
+	var areFriends bool
+	err := db.QueryRow(`
+        SELECT EXISTS(
+            SELECT 1 FROM friendships 
+            WHERE status = 'accepted' 
+            AND ((requester_id = ? AND addressee_id = ?) 
+                OR (requester_id = ? AND addressee_id = ?))
+        )`,
+		userID, challenge.OpponentID,
+		challenge.OpponentID, userID).Scan(&areFriends)
+
+	if err != nil || !areFriends {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Can only challenge friends"})
+		return
+	}
+
+	// Началото и краят са цели календарни дни в зоната на създателя
+	loc, err := getUserLocation(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create challenge"})
+		return
+	}
+	challenge.StartDate, _ = models.CalendarDay(challenge.StartDate, loc)
+	_, challenge.EndDate = models.CalendarDay(challenge.EndDate, loc)
+	if challenge.EndDate.Before(challenge.StartDate) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "End date must not be before start date"})
+		return
+	}
+
+	result, err := db.Exec(`
+        INSERT INTO challenges (creator_id, opponent_id, start_date, end_date) 
+        VALUES (?, ?, ?, ?)`,
+		userID, challenge.OpponentID, challenge.StartDate.UTC(), challenge.EndDate.UTC())
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create challenge"})
+		return
+	}
+
+	challengeID, _ := result.LastInsertId()
+
+	// Записваме началното тегло на създателя
+	initialWeight, err := latestDailyWeight(userID)
+
+	if err == nil {
+		_, err = db.Exec(`
+            INSERT INTO challenge_results (challenge_id, user_id, initial_weight) 
+            VALUES (?, ?, ?)`,
+			challengeID, userID, initialWeight)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "Challenge created",
+		"challengeId": challengeID,
+	})
+}
+
+func acceptChallenge(c *gin.Context) {
+	userID := getUserID(c)
+	challengeID := c.Param("challengeId")
+
+	// Проверяваме дали предизвикателството съществува и е за този потребител
+	var challenge models.Challenge
+	err := db.QueryRow(`
+        SELECT id, creator_id, opponent_id, status 
+        FROM challenges 
+        WHERE id = ?`,
+		challengeID).Scan(&challenge.ID, &challenge.CreatorID, &challenge.OpponentID, &challenge.Status)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Challenge not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	// Проверяваме дали потребителят е получателят на предизвикателството
+	if challenge.OpponentID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can only accept challenges sent to you"})
+		return
+	}
+
+	// Проверяваме дали предизвикателството е в изчакващо състояние
+	if challenge.Status != "pending" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Challenge cannot be accepted"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Transaction error"})
+		return
+	}
+
+	// Обновяваме статуса на предизвикателството
+	_, err = tx.Exec(`
+        UPDATE challenges 
+        SET status = 'active' 
+        WHERE id = ?`,
+		challengeID)
+
+	if err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update challenge"})
+		return
+	}
+
+	// Опитваме се да вземем последното тегло, ако има такова
+	initialWeight, err := latestDailyWeight(userID)
+
+	// Записваме началното тегло само ако има такова
+	if err == nil {
+		_, err = tx.Exec(`
+            INSERT INTO challenge_results (challenge_id, user_id, initial_weight) 
+            VALUES (?, ?, ?)`,
+			challengeID, userID, initialWeight)
+
+		if err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not save initial weight"})
+			return
+		}
+	}
+
+	tx.Commit()
+	c.JSON(http.StatusOK, gin.H{"message": "Challenge accepted"})
+}
+
+func rejectChallenge(c *gin.Context) {
+	userID := getUserID(c)
+	challengeID := c.Param("challengeId")
+
+	result, err := db.Exec(`
+        UPDATE challenges 
+        SET status = 'rejected' 
+        WHERE id = ? AND opponent_id = ? AND status = 'pending'`,
+		challengeID, userID)
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not reject challenge"})
+		return
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid challenge"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Challenge rejected"})
+}
+
+func getChallenges(c *gin.Context) {
+	userID := getUserID(c)
+
+	// Debug log
+	log.Printf("Fetching challenges for user ID: %d", userID)
+
+	rows, err := db.Query(`
+        SELECT c.id, c.creator_id, c.opponent_id, c.start_date, c.end_date, c.status, c.created_at, c.updated_at,
+               creator.username as creator_name, opponent.username as opponent_name
+        FROM challenges c
+        JOIN users creator ON c.creator_id = creator.id
+        JOIN users opponent ON c.opponent_id = opponent.id
+        WHERE c.creator_id = ? OR c.opponent_id = ?
+        ORDER BY c.created_at DESC
+    `, userID, userID)
+	if err != nil {
+		log.Printf("Error querying challenges: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Грешка при зареждане на предизвикателствата"})
+		return
+	}
+	defer rows.Close()
+
+	var challenges []models.Challenge
+	for rows.Next() {
+		var challenge models.Challenge
+		err := rows.Scan(
+			&challenge.ID,
+			&challenge.CreatorID,
+			&challenge.OpponentID,
+			&challenge.StartDate,
+			&challenge.EndDate,
+			&challenge.Status,
+			&challenge.CreatedAt,
+			&challenge.UpdatedAt,
+			&challenge.CreatorName,
+			&challenge.OpponentName,
+		)
+		if err != nil {
+			log.Printf("Error scanning challenge: %v", err)
+			continue
+		}
+
+		// Debug log
+		log.Printf("Loaded challenge: %+v", challenge)
+
+		challenges = append(challenges, challenge)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Error iterating challenges: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Грешка при четене на предизвикателствата"})
+		return
+	}
+
+	// Debug log
+	log.Printf("Returning %d challenges", len(challenges))
+
+	c.JSON(http.StatusOK, challenges)
+}
+
+func getChallengeResults(c *gin.Context) {
+	userID := getUserID(c)
+	challengeID := c.Param("challengeId")
+
+	// Проверяваме дали потребителят участва в това предизвикателство
+	var challenge models.Challenge
+	err := db.QueryRow(`
+        SELECT c.id, c.creator_id, c.opponent_id, c.start_date, c.end_date, c.status, c.created_at, c.updated_at,
+               u1.username as creator_name, u2.username as opponent_name
+        FROM challenges c
+        JOIN users u1 ON c.creator_id = u1.id
+        JOIN users u2 ON c.opponent_id = u2.id
+        WHERE c.id = ? AND (c.creator_id = ? OR c.opponent_id = ?)`,
+		challengeID, userID, userID).Scan(
+		&challenge.ID, &challenge.CreatorID, &challenge.OpponentID,
+		&challenge.StartDate, &challenge.EndDate, &challenge.Status, &challenge.CreatedAt, &challenge.UpdatedAt,
+		&challenge.CreatorName, &challenge.OpponentName)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Challenge not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	weightUnit, _, err := getUnitPreferences(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	// Резултатите на всеки участник са от каноничните тегла по дни според неговите
+	// зона и правило, както в статистиката му
+	challenge.Results = make([]models.ChallengeResult, 0)
+	participants := []struct {
+		id       int
+		username string
+	}{
+		{challenge.CreatorID, challenge.CreatorName},
+		{challenge.OpponentID, challenge.OpponentName},
+	}
+	for _, participant := range participants {
+		result, err := computeChallengeResult(participant.id, challenge.EndDate)
+		if err != nil {
+			log.Printf("Error fetching results: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch results"})
+			return
+		}
+		result.ChallengeID = challenge.ID
+		result.Username = participant.username
+		result.ConvertTo(weightUnit)
+		challenge.Results = append(challenge.Results, result)
+	}
+
+	log.Printf("Challenge results: %+v", challenge) // Debug log
+	c.JSON(http.StatusOK, challenge)
+}
+
+// latestDailyWeight връща каноничното тегло за последния ден със записи или sql.ErrNoRows
+func latestDailyWeight(userID int) (float64, error) {
+	loc, policy, err := getDailyPreferences(userID)
+	if err != nil {
+		return 0, err
+	}
+	days, err := queryDailyWeights(userID, policy, loc, nil, nil, true, 1)
+	if err != nil {
+		return 0, err
+	}
+	if len(days) == 0 {
+		return 0, sql.ErrNoRows
+	}
+	return days[0].Weight, nil
+}
+
+// computeChallengeResult сравнява първия ден със записи на участника с последния
+// ден до края на предизвикателството. Без записи теглата и прогресът са 0.
+func computeChallengeResult(userID int, endDate time.Time) (models.ChallengeResult, error) {
+	result := models.ChallengeResult{UserID: userID}
+
+	loc, policy, err := getDailyPreferences(userID)
+	if err != nil {
+		return result, err
+	}
+	first, err := queryDailyWeights(userID, policy, loc, nil, &endDate, false, 1)
+	if err != nil {
+		return result, err
+	}
+	last, err := queryDailyWeights(userID, policy, loc, nil, &endDate, true, 1)
+	if err != nil {
+		return result, err
+	}
+	if len(first) == 0 || len(last) == 0 {
+		return result, nil
+	}
+
+	result.InitialWeight = first[0].Weight
+	result.FinalWeight = last[0].Weight
+	result.Progress = models.CalculateProgress(result.InitialWeight, result.FinalWeight)
+	return result, nil
+}
+
+func resetPassword(c *gin.Context) {
+	var req struct {
+		Username string `json:"username"`
+	}
+
+	if err := c.BindJSON(&req); err != nil || req.Username == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Username is required"})
+		return
+	}
+
+	// Отговаряме еднакво независимо дали потребителят съществува,
+	// за да не може да се проверява кои акаунти са регистрирани
+	response := gin.H{"message": "If the account exists, a reset link has been sent to its email"}
+
+	var userID int
+	var email sql.NullString
+	err := db.QueryRow("SELECT id, email FROM users WHERE username = ?", req.Username).Scan(&userID, &email)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusOK, response)
+			return
+		}
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if !email.Valid || email.String == "" {
+		log.Printf("Password reset requested for user %d without email", userID)
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	// Грешката при изпращане само се записва - различен отговор би издал, че акаунтът съществува
+	if err := sendPasswordResetEmail(userID, email.String); err != nil {
+		log.Printf("Error sending reset email to user %d: %v", userID, err)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// sendPasswordResetEmail създава нов еднократен токен за смяна на паролата и го изпраща по пощата
+func sendPasswordResetEmail(userID int, email string) error {
+	token, tokenHash, err := auth.NewOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	// Старите неизползвани токени стават невалидни
+	_, err = db.Exec(`
+        UPDATE password_resets
+        SET used_at = CURRENT_TIMESTAMP
+        WHERE user_id = ? AND used_at IS NULL`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+        INSERT INTO password_resets (user_id, token_hash, expires_at)
+        VALUES (?, ?, ?)`,
+		userID, tokenHash, time.Now().Add(passwordResetTTL))
+	if err != nil {
+		return err
+	}
+
+	return mailSender.Send(mailer.Message{
+		To:      email,
+		Subject: "Weight Challenge password reset",
+		Body: fmt.Sprintf("Use the link below to choose a new password. It expires in %s.\r\n\r\n%s/?resetToken=%s",
+			passwordResetTTL, apiURL, token),
+	})
+}
+
+func confirmPasswordReset(c *gin.Context) {
+	var req struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"newPassword"`
+	}
+
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	if req.Token == "" || req.NewPassword == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Token and new password are required"})
+		return
+	}
+
+	var resetID, userID int
+	var username string
+	var expiresAt time.Time
+	var usedAt sql.NullTime
+	err := db.QueryRow(`
+        SELECT pr.id, pr.user_id, u.username, pr.expires_at, pr.used_at
+        FROM password_resets pr
+        JOIN users u ON u.id = pr.user_id
+        WHERE pr.token_hash = ?`,
+		auth.HashToken(req.Token)).Scan(&resetID, &userID, &username, &expiresAt, &usedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token"})
+			return
+		}
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if usedAt.Valid || time.Now().After(expiresAt) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token"})
+		return
+	}
+
+	if !checkPasswordPolicy(c, req.NewPassword, username) {
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not process new password"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Transaction error"})
+		return
+	}
+
+	// Маркираме токена като използван; проверката за used_at пази от двойна употреба
+	result, err := tx.Exec(`
+        UPDATE password_resets
+        SET used_at = CURRENT_TIMESTAMP
+        WHERE id = ? AND used_at IS NULL`, resetID)
+	if err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not reset password"})
+		return
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		tx.Rollback()
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token"})
+		return
+	}
+
+	_, err = tx.Exec("UPDATE users SET password = ? WHERE id = ?", string(hashedPassword), userID)
+	if err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update password"})
+		return
+	}
+
+	_, err = tx.Exec(`
+        UPDATE sessions
+        SET revoked_at = CURRENT_TIMESTAMP
+        WHERE user_id = ? AND revoked_at IS NULL`, userID)
+	if err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not revoke sessions"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not reset password"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password has been reset"})
+}
+
+func importWeights(c *gin.Context) {
+	userID := getUserID(c)
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImportSize)
+
+	weightUnit, _, err := getUnitPreferences(userID)
+	if err != nil {
+		log.Printf("Error fetching unit preferences: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	// Дати без зона се тълкуват в зоната на потребителя
+	loc, err := getUserLocation(userID)
+	if err != nil {
+		log.Printf("Error fetching user timezone: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	unit := c.DefaultQuery("unit", weightUnit)
+	if _, err := models.ToKilograms(0, unit); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Файлът може да дойде като multipart поле "file" или директно в тялото
+	var body io.Reader = c.Request.Body
+	contentType := c.ContentType()
+	if contentType == "multipart/form-data" {
+		file, header, err := c.Request.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "File is required"})
+			return
+		}
+		defer file.Close()
+		body = file
+		if strings.HasSuffix(strings.ToLower(header.Filename), ".json") {
+			contentType = "application/json"
+		} else {
+			contentType = "text/csv"
+		}
+	}
+
+	var rows []importer.Row
+	switch contentType {
+	case "application/json":
+		rows, err = importer.ParseJSON(body, unit)
+	case "text/csv", "text/plain", "application/csv":
+		rows, err = importer.ParseCSV(body, importer.CSVOptions{
+			DateFormat:   c.Query("dateFormat"),
+			DateColumn:   c.Query("dateColumn"),
+			WeightColumn: c.Query("weightColumn"),
+			UnitColumn:   c.Query("unitColumn"),
+			DefaultUnit:  unit,
+			Location:     loc,
+		})
+	default:
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Use text/csv or application/json"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	report := models.ImportReport{Rows: make([]models.ImportRowResult, 0, len(rows))}
+	now := time.Now()
+
+	// Валидираме всички редове и намираме периода за проверка на дубликати
+	var minTime, maxTime time.Time
+	for i := range rows {
+		if rows[i].Err == nil {
+			rows[i].Err = models.ValidateWeightRecord(rows[i].Weight, rows[i].CreatedAt, now)
+		}
+		if rows[i].Err != nil {
+			continue
+		}
+		if minTime.IsZero() || rows[i].CreatedAt.Before(minTime) {
+			minTime = rows[i].CreatedAt
+		}
+		if maxTime.IsZero() || rows[i].CreatedAt.After(maxTime) {
+			maxTime = rows[i].CreatedAt
+		}
+	}
+
+	// Съществуващите записи се сравняват по време с точност до секунда, колкото пази TIMESTAMP.
+	// Зареждаме и дните преди периода, защото от тях започва трендът за отклоненията.
+	existing := make(map[int64]bool)
+	var reference []models.WeightRecord
+	if !minTime.IsZero() {
+		since := minTime.AddDate(0, 0, -models.OutlierLookbackDays)
+		records, _, err := queryWeightHistory(userID, &since, &maxTime, nil, 0, true)
+		if err != nil {
+			log.Printf("Error fetching existing records: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not import weight records"})
+			return
+		}
+		for i := len(records) - 1; i >= 0; i-- {
+			existing[records[i].CreatedAt.Unix()] = true
+			if !records[i].IsOutlier {
+				reference = append(reference, records[i])
+			}
+		}
+	}
+
+	// Редовете се отбелязват като отклонения както при ръчно добавяне, освен ако
+	// вносът не е потвърден с confirm=true
+	outliers := make(map[int]bool)
+	if c.Query("confirm") != "true" {
+		outliers = detectImportOutliers(rows, existing, reference)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Transaction error"})
+		return
+	}
+
+	for i, row := range rows {
+		result := models.ImportRowResult{Line: row.Line}
+		if row.Err != nil {
+			result.Status = models.ImportRejected
+			result.Error = row.Err.Error()
+			report.Rejected++
+			report.Rows = append(report.Rows, result)
+			continue
+		}
+
+		createdAt := row.CreatedAt.UTC()
+		result.Weight = models.FromKilograms(row.Weight, weightUnit)
+		result.CreatedAt = &createdAt
+
+		if existing[createdAt.Unix()] {
+			result.Status = models.ImportDuplicate
+			report.Duplicates++
+			report.Rows = append(report.Rows, result)
+			continue
+		}
+
+		result.IsOutlier = outliers[i]
+		_, err := tx.Exec("INSERT INTO weight_records (user_id, weight, is_outlier, created_at) VALUES (?, ?, ?, ?)",
+			userID, row.Weight, result.IsOutlier, createdAt)
+		if err != nil {
+			tx.Rollback()
+			log.Printf("Error importing weight record: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not import weight records"})
+			return
+		}
+
+		existing[createdAt.Unix()] = true
+		result.Status = models.ImportAccepted
+		report.Accepted++
+		if result.IsOutlier {
+			report.Outliers++
+		}
+		report.Rows = append(report.Rows, result)
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing import: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not import weight records"})
+		return
+	}
+
+	log.Printf("User %d imported %d weight records (%d rejected, %d duplicates)",
+		userID, report.Accepted, report.Rejected, report.Duplicates)
+	c.JSON(http.StatusOK, report)
+}
+
+// detectImportOutliers връща индексите на редовете, които ще се запишат като отклонения.
+// Редовете се проверяват в хронологичен ред; дубликатите, които няма да се запишат, се пропускат.
+func detectImportOutliers(rows []importer.Row, existing map[int64]bool, reference []models.WeightRecord) map[int]bool {
+	var indexes []int
+	seen := make(map[int64]bool)
+	for i, row := range rows {
+		second := row.CreatedAt.Unix()
+		if row.Err != nil || existing[second] || seen[second] {
+			continue
+		}
+		seen[second] = true
+		indexes = append(indexes, i)
+	}
+	sort.SliceStable(indexes, func(a, b int) bool {
+		return rows[indexes[a]].CreatedAt.Before(rows[indexes[b]].CreatedAt)
+	})
+
+	added := make([]models.WeightRecord, len(indexes))
+	for k, i := range indexes {
+		added[k] = models.WeightRecord{Weight: rows[i].Weight, CreatedAt: rows[i].CreatedAt.UTC()}
+	}
+
+	outliers := make(map[int]bool)
+	for k, flagged := range models.DetectOutliers(reference, added) {
+		if flagged {
+			outliers[indexes[k]] = true
+		}
+	}
+	return outliers
+}
+
+// exportWeights изпраща записите ред по ред, без да ги зарежда всички в паметта
+func exportWeights(c *gin.Context) {
 	userID := getUserID(c)
+	format := c.DefaultQuery("format", "csv")
+
+	var contentType string
+	switch format {
+	case "csv":
+		contentType = "text/csv; charset=utf-8"
+	case "tsv":
+		contentType = "text/tab-separated-values; charset=utf-8"
+	case "json":
+		contentType = "application/json"
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv, tsv or json"})
+		return
+	}
+
+	var height float64
+	var loc *time.Location
+	var weightUnit, timezone string
+	err := db.QueryRow("SELECT height, weight_unit, timezone FROM users WHERE id = ?", userID).
+		Scan(&height, &weightUnit, &timezone)
+	if err == nil {
+		loc, err = models.LoadTimezone(timezone)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch user data"})
+		return
+	}
 
 	rows, err := db.Query(`
-        SELECT u.id, u.username, u.height, 
-               COALESCE(
-                   (SELECT ((w1.weight - w2.weight) / w1.weight * 100)
-                    FROM weight_records w1
-                    JOIN weight_records w2 ON w2.user_id = u.id
-                    WHERE w1.user_id = u.id
-                    AND w1.created_at = (SELECT MIN(created_at) FROM weight_records WHERE user_id = u.id)
-                    AND w2.created_at = (SELECT MAX(created_at) FROM weight_records WHERE user_id = u.id)
-                    LIMIT 1
-                   ), 0
-               ) as progress
-        FROM users u
-        JOIN user_settings us ON u.id = us.user_id
-        WHERE us.is_visible = true 
-        AND u.id != ?
-        AND NOT EXISTS (
-            SELECT 1 FROM friendships f
-            WHERE ((f.requester_id = ? AND f.addressee_id = u.id) 
-               OR (f.requester_id = u.id AND f.addressee_id = ?))
-            AND f.status IN ('accepted', 'pending')
-        )`,
-		userID, userID, userID)
+        SELECT id, weight, created_at
+        FROM weight_records
+        WHERE user_id = ? AND deleted_at IS NULL
+        ORDER BY created_at ASC, id ASC`, userID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch users"})
+		log.Printf("Error exporting weight records: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch weight records"})
 		return
 	}
 	defer rows.Close()
 
-	var users []models.UserProfile
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="weight-history.%s"`, format))
+	c.Status(http.StatusOK)
+
+	var writeRow func(models.WeightExportRow) error
+	var flush func()
+	var finish func() error
+
+	switch format {
+	case "json":
+		c.Writer.WriteString("[")
+		encoder := json.NewEncoder(c.Writer)
+		first := true
+		writeRow = func(row models.WeightExportRow) error {
+			if !first {
+				c.Writer.WriteString(",")
+			}
+			first = false
+			return encoder.Encode(row)
+		}
+		flush = func() {}
+		finish = func() error {
+			_, err := c.Writer.WriteString("]")
+			return err
+		}
+	default:
+		// BOM-ът кара Excel да отвори файла като UTF-8
+		c.Writer.WriteString("\ufeff")
+		writer := csv.NewWriter(c.Writer)
+		if format == "tsv" {
+			writer.Comma = '\t'
+		}
+		writer.Write([]string{"id", "date", "weight", "unit", "bmi", "progress"})
+		writeRow = func(row models.WeightExportRow) error {
+			return writer.Write([]string{
+				strconv.Itoa(row.ID),
+				row.CreatedAt.Format(time.RFC3339),
+				strconv.FormatFloat(row.Weight, 'f', 2, 64),
+				row.Unit,
+				strconv.FormatFloat(row.BMI, 'f', 2, 64),
+				strconv.FormatFloat(row.Progress, 'f', 2, 64),
+			})
+		}
+		flush = writer.Flush
+		finish = func() error {
+			writer.Flush()
+			return writer.Error()
+		}
+	}
+
+	var initialWeight float64
+	count := 0
 	for rows.Next() {
-		var user models.UserProfile
-		if err := rows.Scan(&user.ID, &user.Username, &user.Height, &user.Progress); err != nil {
-			continue
+		var row models.WeightExportRow
+		if err := rows.Scan(&row.ID, &row.Weight, &row.CreatedAt); err != nil {
+			log.Printf("Error scanning weight record: %v", err)
+			return
+		}
+
+		if count == 0 {
+			initialWeight = row.Weight
+		}
+		row.BMI = models.CalculateBMI(row.Weight, height)
+		row.Progress = models.CalculateProgress(initialWeight, row.Weight)
+		row.Weight = models.FromKilograms(row.Weight, weightUnit)
+		row.Unit = weightUnit
+		row.CreatedAt = row.CreatedAt.In(loc)
+
+		if err := writeRow(row); err != nil {
+			// Клиентът е прекъснал връзката
+			log.Printf("Error writing export: %v", err)
+			return
+		}
+
+		count++
+		if count%exportFlushEvery == 0 {
+			flush()
+			c.Writer.Flush()
 		}
-		users = append(users, user)
 	}
 
-	c.JSON(http.StatusOK, users)
+	if err := rows.Err(); err != nil {
+		log.Printf("Error reading weight records: %v", err)
+		return
+	}
+
+	if err := finish(); err != nil {
+		log.Printf("Error writing export: %v", err)
+	}
 }
 
-func updateVisibility(c *gin.Context) {
+func updateWeight(c *gin.Context) {
+	var input models.WeightRecordInput
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+		return
+	}
+
+	// PUT заменя целия запис, включително измерванията
+	saveWeightChanges(c, models.WeightRecordPatch{
+		Weight:       &input.Weight,
+		CreatedAt:    &input.CreatedAt,
+		Unit:         input.Unit,
+		Measurements: input.Measurements,
+		Confirm:      input.Confirm,
+	}, true)
+}
+
+func patchWeight(c *gin.Context) {
+	var patch models.WeightRecordPatch
+	if err := c.BindJSON(&patch); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+		return
+	}
+
+	if patch.Weight == nil && patch.CreatedAt == nil && patch.Measurements.IsEmpty() && !patch.Confirm {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Nothing to update"})
+		return
+	}
+
+	saveWeightChanges(c, patch, false)
+}
+
+// saveWeightChanges прилага промяната към записа след проверка на собствеността, както при deleteWeight.
+// При replaceMeasurements измерванията се заменят изцяло, иначе се променят само зададените.
+func saveWeightChanges(c *gin.Context, patch models.WeightRecordPatch, replaceMeasurements bool) {
 	userID := getUserID(c)
-	var settings struct {
-		IsVisible bool `json:"isVisible"`
+	weightID := c.Param("id")
+
+	record, err := loadWeightRecord(weightID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Записът не е намерен"})
+			return
+		}
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
 	}
 
-	if err := c.BindJSON(&settings); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+	if record.UserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Нямате право да редактирате този запис"})
 		return
 	}
 
-	_, err := db.Exec(`
-        INSERT INTO user_settings (user_id, is_visible) 
-        VALUES (?, ?)
-        ON DUPLICATE KEY UPDATE is_visible = ?`,
-		userID, settings.IsVisible, settings.IsVisible)
+	confirmed := patch.Confirm || c.Query("confirm") == "true"
+	if err := applyWeightPatch(&record, patch, replaceMeasurements, confirmed); err != nil {
+		respondWeightError(c, err, "Could not update weight record")
+		return
+	}
+
+	if err := updateWeightRecord(&record); err != nil {
+		log.Printf("Error updating weight record: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update weight record"})
+		return
+	}
+
+	records := []models.WeightRecord{record}
+	if err := presentWeightRecords(userID, records); err != nil {
+		log.Printf("Error fetching user data: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, records[0])
+}
+
+func deleteWeight(c *gin.Context) {
+	userID := getUserID(c)
+	weightID := c.Param("id")
 
+	// Първо проверяваме дали това тегло принадлежи на текущия потребител
+	var ownerID int
+	err := db.QueryRow("SELECT user_id FROM weight_records WHERE id = ? AND deleted_at IS NULL", weightID).Scan(&ownerID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update visibility"})
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Записът не е намерен"})
+			return
+		}
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Visibility updated"})
+	if ownerID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Нямате право да изтриете този запис"})
+		return
+	}
+
+	// Записът се изтрива меко, за да може изтриването да стигне до офлайн клиентите при синхронизация
+	result, err := db.Exec(`
+        UPDATE weight_records
+        SET deleted_at = CURRENT_TIMESTAMP
+        WHERE id = ? AND user_id = ? AND deleted_at IS NULL`, weightID, userID)
+	if err != nil {
+		log.Printf("Error deleting weight record: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete weight record"})
+		return
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Записът не е намерен"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Записът е изтрит успешно"})
 }
 
-func getFriends(c *gin.Context) {
+// getSyncChanges връща промените след курсора since. Без since се връща пълно копие на данните.
+// Границата е включителна, така че клиентът може да получи повторно промени от същата секунда
+// и трябва да ги прилага по id.
+func getSyncChanges(c *gin.Context) {
 	userID := getUserID(c)
 
-	rows, err := db.Query(`
-        SELECT u.id, u.username, u.height, f.status, f.id as friendship_id,
-               COALESCE(
-                   (SELECT ((w1.weight - w2.weight) / w1.weight * 100)
-                    FROM weight_records w1
-                    JOIN weight_records w2 ON w2.user_id = u.id
-                    WHERE w1.user_id = u.id
-                    AND w1.created_at = (SELECT MIN(created_at) FROM weight_records WHERE user_id = u.id)
-                    AND w2.created_at = (SELECT MAX(created_at) FROM weight_records WHERE user_id = u.id)
-                    LIMIT 1
-                   ), 0
-               ) as progress
-        FROM users u
-        JOIN friendships f ON (f.requester_id = u.id OR f.addressee_id = u.id)
-        WHERE (f.requester_id = ? OR f.addressee_id = ?)
-        AND u.id != ?`,
-		userID, userID, userID)
+	since := time.Unix(0, 0).UTC()
+	incremental := c.Query("since") != ""
+	if incremental {
+		var err error
+		since, err = models.DecodeSyncCursor(c.Query("since"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+	}
+
+	// Курсорът и всички заявки четат от една снимка на базата (REPEATABLE READ),
+	// така че промяна, записана междувременно, е или в отговора, или след курсора
+	tx, err := db.BeginTx(c.Request.Context(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch friends"})
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	// InnoDB създава снимката при първото четене от таблица, затова NOW() се чете заедно с него
+	var now time.Time
+	if err := tx.QueryRow("SELECT NOW() FROM users WHERE id = ?", userID).Scan(&now); err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	changes, err := querySyncChanges(tx, userID, since, incremental)
+	if err != nil {
+		log.Printf("Error fetching sync changes: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch changes"})
+		return
+	}
+	if err := presentWeightRecords(userID, changes.WeightRecords); err != nil {
+		log.Printf("Error fetching user data: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
-	defer rows.Close()
 
-	var friends []struct {
-		models.UserProfile
-		Status       string `json:"status"`
-		FriendshipID int    `json:"friendshipId"`
+	changes.Cursor = models.EncodeSyncCursor(now)
+	c.JSON(http.StatusOK, changes)
+}
+
+// querySyncChanges събира записите, приятелствата и предизвикателствата, променени след since.
+// Изтритите обекти се търсят само при incremental - пълното копие съдържа само живите.
+// Всички заявки вървят през tx, за да видят една и съща снимка на данните.
+func querySyncChanges(tx *sql.Tx, userID int, since time.Time, incremental bool) (models.SyncChanges, error) {
+	changes := models.SyncChanges{
+		WeightRecords:        make([]models.WeightRecord, 0),
+		DeletedWeightRecords: make([]int, 0),
+		Friendships:          make([]models.Friendship, 0),
+		DeletedFriendships:   make([]int, 0),
+		Challenges:           make([]models.Challenge, 0),
+		DeletedChallenges:    make([]int, 0),
+	}
+
+	rows, err := tx.Query(`
+        SELECT `+weightRecordColumns+`
+        FROM weight_records
+        LEFT JOIN body_measurements ON body_measurements.weight_record_id = weight_records.id
+        WHERE user_id = ? AND deleted_at IS NULL AND updated_at >= ?
+        ORDER BY created_at, id`, userID, since)
+	if err != nil {
+		return changes, err
+	}
+	for rows.Next() {
+		record, err := scanWeightRecord(rows)
+		if err != nil {
+			rows.Close()
+			return changes, err
+		}
+		changes.WeightRecords = append(changes.WeightRecords, record)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return changes, err
+	}
+
+	rows, err = tx.Query(`
+        SELECT f.id, f.requester_id, f.addressee_id, u.username, f.status, f.created_at, f.updated_at
+        FROM friendships f
+        JOIN users u ON u.id = IF(f.requester_id = ?, f.addressee_id, f.requester_id)
+        WHERE (f.requester_id = ? OR f.addressee_id = ?) AND f.updated_at >= ?
+        ORDER BY f.id`, userID, userID, userID, since)
+	if err != nil {
+		return changes, err
+	}
+	for rows.Next() {
+		var f models.Friendship
+		if err := rows.Scan(&f.ID, &f.RequesterID, &f.AddresseeID, &f.FriendUsername,
+			&f.Status, &f.CreatedAt, &f.UpdatedAt); err != nil {
+			rows.Close()
+			return changes, err
+		}
+		changes.Friendships = append(changes.Friendships, f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return changes, err
+	}
+
+	rows, err = tx.Query(`
+        SELECT c.id, c.creator_id, c.opponent_id, c.start_date, c.end_date, c.status, c.created_at, c.updated_at,
+               creator.username, opponent.username
+        FROM challenges c
+        JOIN users creator ON c.creator_id = creator.id
+        JOIN users opponent ON c.opponent_id = opponent.id
+        WHERE (c.creator_id = ? OR c.opponent_id = ?) AND c.updated_at >= ?
+        ORDER BY c.id`, userID, userID, since)
+	if err != nil {
+		return changes, err
+	}
+	for rows.Next() {
+		var challenge models.Challenge
+		if err := rows.Scan(&challenge.ID, &challenge.CreatorID, &challenge.OpponentID,
+			&challenge.StartDate, &challenge.EndDate, &challenge.Status, &challenge.CreatedAt, &challenge.UpdatedAt,
+			&challenge.CreatorName, &challenge.OpponentName); err != nil {
+			rows.Close()
+			return changes, err
+		}
+		changes.Challenges = append(changes.Challenges, challenge)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return changes, err
+	}
+
+	if !incremental {
+		return changes, nil
+	}
+
+	rows, err = tx.Query(`
+        SELECT id FROM weight_records
+        WHERE user_id = ? AND deleted_at IS NOT NULL AND deleted_at >= ?`, userID, since)
+	if err != nil {
+		return changes, err
+	}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return changes, err
+		}
+		changes.DeletedWeightRecords = append(changes.DeletedWeightRecords, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return changes, err
+	}
+
+	rows, err = tx.Query(`
+        SELECT entity, entity_id FROM sync_tombstones
+        WHERE user_id = ? AND deleted_at >= ?`, userID, since)
+	if err != nil {
+		return changes, err
 	}
-
+	defer rows.Close()
 	for rows.Next() {
-		var friend struct {
-			models.UserProfile
-			Status       string `json:"status"`
-			FriendshipID int    `json:"friendshipId"`
+		var entity string
+		var id int
+		if err := rows.Scan(&entity, &id); err != nil {
+			return changes, err
 		}
-		if err := rows.Scan(&friend.ID, &friend.Username, &friend.Height, &friend.Status, &friend.FriendshipID, &friend.Progress); err != nil {
-			continue
+		switch entity {
+		case "friendship":
+			changes.DeletedFriendships = append(changes.DeletedFriendships, id)
+		case "challenge":
+			changes.DeletedChallenges = append(changes.DeletedChallenges, id)
 		}
-		friends = append(friends, friend)
 	}
-
-	c.JSON(http.StatusOK, friends)
+	return changes, rows.Err()
 }
 
-func sendFriendRequest(c *gin.Context) {
-	userID := getUserID(c)
-	friendIDStr := c.Param("userId")
-
-	// Проверяваме дали ID-то не е празно
-	if friendIDStr == "" {
-		log.Printf("Липсващо ID на потребител в заявката")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Не е предоставено ID на потребител"})
-		return
-	}
-
-	// Конвертираме friendID в число
-	friendID, err := strconv.Atoi(friendIDStr)
-	if err != nil {
-		log.Printf("Невалидно ID на потребител: %v (стойност: %s)", err, friendIDStr)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Невалидно ID на потребител"})
+// pushSyncChanges прилага промените, направени на клиента без връзка, по реда на подаването им.
+// Правила при конфликт:
+//   - create със същия clientId (или без clientId - със същото време) и същото тегло като
+//     съществуващ запис е повторно изпращане (duplicate), а с различно тегло или вече
+//     изтрит запис е конфликт;
+//   - update на изтрит запис или на запис, променен на сървъра след baseUpdatedAt, е конфликт
+//     и сървърната версия печели; без baseUpdatedAt промяната се прилага безусловно;
+//   - delete винаги се прилага и е идемпотентен.
+func pushSyncChanges(c *gin.Context) {
+	var req models.SyncPushRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-
-	// Проверяваме дали потребителят не се опитва да добави себе си
-	if friendID == userID {
-		log.Printf("Потребител %d се опитва да добави себе си за приятел", userID)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Не можете да добавите себе си за приятел"})
+	if len(req.WeightRecords) > models.MaxSyncBatch {
+		c.JSON(http.StatusBadRequest, gin.H{"error": models.ErrSyncBatchTooLarge.Error()})
 		return
 	}
 
-	// Debug logging
-	log.Printf("Получена заявка за приятелство от потребител %d към потребител %d", userID, friendID)
-
-	// Проверяваме дали потребителят съществува
-	var exists bool
-	err = db.QueryRow(`
-        SELECT EXISTS(
-            SELECT 1 FROM users 
-            WHERE id = ?
-        )`, friendID).Scan(&exists)
+	userID := getUserID(c)
+	response := models.SyncPushResponse{Results: make([]models.SyncChangeResult, 0, len(req.WeightRecords))}
+	var records []models.WeightRecord
+	var recordResults []int
 
-	if err != nil {
-		log.Printf("Грешка при проверка на потребителя: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Възникна грешка при проверка на потребителя"})
-		return
+	for _, change := range req.WeightRecords {
+		result, record, err := applySyncChange(userID, change)
+		if err != nil {
+			var invalid *inputError
+			if !errors.As(err, &invalid) {
+				log.Printf("Error applying sync change: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not apply changes"})
+				return
+			}
+			result.Status = models.SyncStatusRejected
+			result.Error = invalid.Error()
+		}
+		if record != nil {
+			records = append(records, *record)
+			recordResults = append(recordResults, len(response.Results))
+		}
+		response.Results = append(response.Results, result)
 	}
 
-	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Потребителят не е намерен"})
+	if err := presentWeightRecords(userID, records); err != nil {
+		log.Printf("Error fetching user data: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
+	for i, index := range recordResults {
+		response.Results[index].Record = &records[i]
+	}
 
-	// Проверяваме дали вече има активна или изчакваща заявка между тези потребители
-	err = db.QueryRow(`
-        SELECT EXISTS(
-            SELECT 1 FROM friendships 
-            WHERE ((requester_id = ? AND addressee_id = ?) 
-               OR (requester_id = ? AND addressee_id = ?))
-            AND status IN ('pending', 'accepted')
-        )`, userID, friendID, friendID, userID).Scan(&exists)
+	c.JSON(http.StatusOK, response)
+}
 
-	if err != nil {
-		log.Printf("Грешка при проверка за съществуваща заявка: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Възникна грешка при проверка за съществуваща заявка"})
-		return
-	}
+// applySyncChange прилага една промяна. Грешките във входа са *inputError и отхвърлят само тази промяна.
+func applySyncChange(userID int, change models.WeightChange) (models.SyncChangeResult, *models.WeightRecord, error) {
+	result := models.SyncChangeResult{ClientID: change.ClientID, ID: change.ID, Action: change.Action}
 
-	if exists {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Вече съществува активна заявка за приятелство между тези потребители"})
-		return
-	}
+	switch change.Action {
+	case models.SyncActionCreate:
+		if len(change.ClientID) > models.MaxSyncClientIDLength {
+			return result, nil, &inputError{models.ErrSyncClientID}
+		}
+		record, err := newWeightRecord(userID, change.Input(), change.Confirm)
+		if err != nil {
+			return result, nil, err
+		}
 
-	// Първо проверяваме дали има отхвърлена заявка и я актуализираме
-	result, err := db.Exec(`
-        UPDATE friendships 
-        SET status = 'pending', requester_id = ?, addressee_id = ?, updated_at = CURRENT_TIMESTAMP
-        WHERE (requester_id = ? AND addressee_id = ?) 
-           OR (requester_id = ? AND addressee_id = ?)
-           AND status = 'rejected'`,
-        userID, friendID, userID, friendID, friendID, userID)
+		// Клиентът може да изпрати записа повторно, ако не е получил отговор.
+		// В базата времето е с точност до секунда, затова сравняваме без дробната част.
+		record.CreatedAt = record.CreatedAt.Truncate(time.Second)
+		record.ClientID = change.ClientID
+		existing, deletedID, err := findSyncCreated(userID, record)
+		if err != nil {
+			return result, nil, err
+		}
+		// Записът е създаден при предишно изпращане и след това изтрит - изтриването печели
+		if deletedID != 0 {
+			result.ID = deletedID
+			result.Status = models.SyncStatusConflict
+			result.Error = "Записът е изтрит"
+			return result, nil, nil
+		}
+		if status := models.SyncCreateStatus(existing, record); status != models.SyncStatusApplied {
+			result.ID = existing.ID
+			result.Status = status
+			return result, existing, nil
+		}
 
-	if err != nil {
-		log.Printf("Грешка при обновяване на съществуваща заявка: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Възникна грешка при обновяване на заявката"})
-		return
-	}
+		if err := insertWeightRecord(&record); err != nil {
+			return result, nil, err
+		}
+		result.ID = record.ID
+		result.Status = models.SyncStatusApplied
+		return result, &record, nil
+
+	case models.SyncActionUpdate:
+		var ownerID int
+		var deleted bool
+		err := db.QueryRow("SELECT user_id, deleted_at IS NOT NULL FROM weight_records WHERE id = ?", change.ID).
+			Scan(&ownerID, &deleted)
+		if err == sql.ErrNoRows || (err == nil && ownerID != userID) {
+			return result, nil, &inputError{errors.New("Записът не е намерен")}
+		}
+		if err != nil {
+			return result, nil, err
+		}
+		if deleted {
+			result.Status = models.SyncStatusConflict
+			result.Error = "Записът е изтрит"
+			return result, nil, nil
+		}
 
-	rowsAffected, _ := result.RowsAffected()
-	
-	// Ако няма отхвърлена заявка за обновяване, създаваме нова
-	if rowsAffected == 0 {
-		_, err = db.Exec(`
-            INSERT INTO friendships (requester_id, addressee_id) 
-            VALUES (?, ?)`,
-            userID, friendID)
+		record, err := loadWeightRecord(change.ID)
+		if err != nil {
+			return result, nil, err
+		}
+		if models.SyncUpdateStatus(record, change.BaseUpdatedAt) == models.SyncStatusConflict {
+			result.Status = models.SyncStatusConflict
+			return result, &record, nil
+		}
 
+		if err := applyWeightPatch(&record, change.Patch(), false, change.Confirm); err != nil {
+			return result, nil, err
+		}
+		if err := updateWeightRecord(&record); err != nil {
+			return result, nil, err
+		}
+		result.Status = models.SyncStatusApplied
+		return result, &record, nil
+
+	case models.SyncActionDelete:
+		_, err := db.Exec(`
+            UPDATE weight_records
+            SET deleted_at = CURRENT_TIMESTAMP
+            WHERE id = ? AND user_id = ? AND deleted_at IS NULL`, change.ID, userID)
 		if err != nil {
-			log.Printf("Грешка при създаване на нова заявка за приятелство: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Възникна грешка при създаване на заявката"})
-			return
+			return result, nil, err
 		}
+		result.Status = models.SyncStatusApplied
+		return result, nil, nil
 	}
 
-	log.Printf("Успешно създадена/обновена заявка за приятелство от %d към %d", userID, friendID)
-	c.JSON(http.StatusOK, gin.H{"message": "Заявката за приятелство е изпратена успешно"})
+	return result, nil, &inputError{models.ErrInvalidSyncAction}
 }
 
-func acceptFriendRequest(c *gin.Context) {
-	userID := getUserID(c)
-	friendshipID := c.Param("friendshipId")
-
-	// Проверяваме дали приятелството съществува
-	var exists bool
-	err := db.QueryRow(`
-        SELECT EXISTS(
-            SELECT 1 FROM friendships 
-            WHERE id = ?
-        )`, friendshipID).Scan(&exists)
+// findSyncCreated търси вече създаден запис за същата промяна: по clientId, а при
+// стари клиенти без clientId - по времето, като предпочита записа с най-близко тегло.
+// Ако записът с този clientId вече е изтрит, се връща само неговото ID като deletedID.
+func findSyncCreated(userID int, record models.WeightRecord) (existing *models.WeightRecord, deletedID int, err error) {
+	var existingID int
+	var deleted bool
+	if record.ClientID != "" {
+		err = db.QueryRow(`
+            SELECT id, deleted_at IS NOT NULL FROM weight_records
+            WHERE user_id = ? AND client_id = ?`, userID, record.ClientID).Scan(&existingID, &deleted)
+	} else {
+		err = db.QueryRow(`
+            SELECT id FROM weight_records
+            WHERE user_id = ? AND created_at = ? AND deleted_at IS NULL
+            ORDER BY ABS(weight - ?)
+            LIMIT 1`, userID, record.CreatedAt, record.Weight).Scan(&existingID)
+	}
+	if err == sql.ErrNoRows {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if deleted {
+		return nil, existingID, nil
+	}
 
+	loaded, err := loadWeightRecord(existingID)
+	if err == sql.ErrNoRows {
+		// Записът е изтрит между двете заявки
+		return nil, existingID, nil
+	}
 	if err != nil {
-		log.Printf("Грешка при проверка на приятелството: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Възникна грешка при проверка на приятелството"})
-		return
+		return nil, 0, err
 	}
+	return &loaded, 0, nil
+}
 
-	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Приятелството не съществува"})
+func adminListUsers(c *gin.Context) {
+	query := strings.TrimSpace(c.Query("q"))
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 || limit > 200 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid offset"})
 		return
 	}
 
-	// Проверяваме дали потребителят има право да приеме това приятелство
-	var isAddressee bool
-	err = db.QueryRow(`
-        SELECT EXISTS(
-            SELECT 1 FROM friendships 
-            WHERE id = ? AND addressee_id = ? AND status = 'pending'
-        )`, friendshipID, userID).Scan(&isAddressee)
-
+	pattern := "%" + query + "%"
+	rows, err := db.Query(`
+        SELECT id, username, COALESCE(email, ''), role, email_verified_at IS NOT NULL,
+               disabled_at IS NOT NULL, created_at
+        FROM users
+        WHERE ? = '' OR username LIKE ? OR email LIKE ?
+        ORDER BY id
+        LIMIT ? OFFSET ?`,
+		query, pattern, pattern, limit, offset)
 	if err != nil {
-		log.Printf("Грешка при проверка на правата: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Възникна грешка при проверка на правата"})
+		log.Printf("Error listing users: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch users"})
 		return
 	}
+	defer rows.Close()
 
-	if !isAddressee {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Нямате право да приемете това приятелство или то вече е обработено"})
-		return
+	users := make([]models.AdminUser, 0)
+	for rows.Next() {
+		var user models.AdminUser
+		if err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.Role,
+			&user.EmailVerified, &user.Disabled, &user.CreatedAt); err != nil {
+			log.Printf("Error scanning user: %v", err)
+			continue
+		}
+		users = append(users, user)
 	}
 
-	result, err := db.Exec(`
-        UPDATE friendships 
-        SET status = 'accepted' 
-        WHERE id = ? AND addressee_id = ? AND status = 'pending'`,
-        friendshipID, userID)
+	c.JSON(http.StatusOK, users)
+}
 
+func adminSetUserRole(c *gin.Context) {
+	targetID, err := strconv.Atoi(c.Param("userId"))
 	if err != nil {
-		log.Printf("Грешка при приемане на приятелството: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Възникна грешка при приемане на приятелството"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
 		return
 	}
 
-	rows, _ := result.RowsAffected()
-	if rows == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Приятелството не може да бъде прието"})
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := c.BindJSON(&req); err != nil || !models.IsValidRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Приятелството е прието успешно"})
-}
-
-func rejectFriendRequest(c *gin.Context) {
-	userID := getUserID(c)
-	friendshipID := c.Param("friendshipId")
-
-	result, err := db.Exec(`
-        UPDATE friendships 
-        SET status = 'rejected' 
-        WHERE id = ? AND addressee_id = ?`,
-		friendshipID, userID)
+	// Администраторът не може да отнеме собствените си права
+	if targetID == getUserID(c) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot change your own role"})
+		return
+	}
 
+	result, err := db.Exec("UPDATE users SET role = ? WHERE id = ?", req.Role, targetID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not reject friend request"})
+		log.Printf("Error updating role: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update role"})
 		return
 	}
 
-	rows, _ := result.RowsAffected()
-	if rows == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Friend request rejected"})
+	log.Printf("Admin %d set role of user %d to %s", getUserID(c), targetID, req.Role)
+	c.JSON(http.StatusOK, gin.H{"message": "Role updated"})
 }
 
-func createChallenge(c *gin.Context) {
-	userID := getUserID(c)
-	var challenge models.Challenge
+func adminSetUserDisabled(c *gin.Context) {
+	targetID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
 
-	if err := c.BindJSON(&challenge); err != nil {
+	var req struct {
+		Disabled bool `json:"disabled"`
+	}
+	if err := c.BindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
 		return
 	}
 
-	// Проверяваме дали са приятели
-	var areFriends bool
-	err := db.QueryRow(`
-        SELECT EXISTS(
-            SELECT 1 FROM friendships 
-            WHERE status = 'accepted' 
-            AND ((requester_id = ? AND addressee_id = ?) 
-                OR (requester_id = ? AND addressee_id = ?))
-        )`,
-		userID, challenge.OpponentID,
-		challenge.OpponentID, userID).Scan(&areFriends)
-
-	if err != nil || !areFriends {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Can only challenge friends"})
+	if targetID == getUserID(c) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot disable your own account"})
 		return
 	}
 
-	result, err := db.Exec(`
-        INSERT INTO challenges (creator_id, opponent_id, start_date, end_date) 
-        VALUES (?, ?, ?, ?)`,
-		userID, challenge.OpponentID, challenge.StartDate, challenge.EndDate)
-
+	var result sql.Result
+	if req.Disabled {
+		result, err = db.Exec("UPDATE users SET disabled_at = COALESCE(disabled_at, CURRENT_TIMESTAMP) WHERE id = ?", targetID)
+	} else {
+		result, err = db.Exec("UPDATE users SET disabled_at = NULL WHERE id = ?", targetID)
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create challenge"})
+		log.Printf("Error updating account status: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update account"})
 		return
 	}
 
-	challengeID, _ := result.LastInsertId()
-
-	// Записваме началното тегло на създателя
-	var initialWeight float64
-	err = db.QueryRow(`
-        SELECT weight FROM weight_records 
-        WHERE user_id = ? 
-        ORDER BY created_at DESC LIMIT 1`,
-		userID).Scan(&initialWeight)
-
-	if err == nil {
-		_, err = db.Exec(`
-            INSERT INTO challenge_results (challenge_id, user_id, initial_weight) 
-            VALUES (?, ?, ?)`,
-			challengeID, userID, initialWeight)
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		var exists bool
+		db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)", targetID).Scan(&exists)
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"message":     "Challenge created",
-		"challengeId": challengeID,
-	})
-}
+	// Блокираният потребител губи всички активни сесии
+	if req.Disabled {
+		if err := revokeUserSessions(db, targetID); err != nil {
+			log.Printf("Error revoking sessions: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not revoke sessions"})
+			return
+		}
+	}
 
-func acceptChallenge(c *gin.Context) {
-	userID := getUserID(c)
-	challengeID := c.Param("challengeId")
+	log.Printf("Admin %d set disabled=%t for user %d", getUserID(c), req.Disabled, targetID)
+	c.JSON(http.StatusOK, gin.H{"message": "Account updated"})
+}
 
-	// Проверяваме дали предизвикателството съществува и е за този потребител
-	var challenge models.Challenge
-	err := db.QueryRow(`
-        SELECT id, creator_id, opponent_id, status 
-        FROM challenges 
-        WHERE id = ?`,
-		challengeID).Scan(&challenge.ID, &challenge.CreatorID, &challenge.OpponentID, &challenge.Status)
+func adminForcePasswordReset(c *gin.Context) {
+	targetID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
 
+	var email sql.NullString
+	err = db.QueryRow("SELECT email FROM users WHERE id = ?", targetID).Scan(&email)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Challenge not found"})
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 			return
 		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
 
-	// Проверяваме дали потребителят е получателят на предизвикателството
-	if challenge.OpponentID != userID {
-		c.JSON(http.StatusForbidden, gin.H{"error": "You can only accept challenges sent to you"})
+	// Заменяме паролата със случайна, която никой не знае
+	randomPassword, _, err := auth.NewOpaqueToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not reset password"})
 		return
 	}
-
-	// Проверяваме дали предизвикателството е в изчакващо състояние
-	if challenge.Status != "pending" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Challenge cannot be accepted"})
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(randomPassword), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not reset password"})
 		return
 	}
 
+	// Без обща транзакция старите сесии биха останали активни при грешка след смяната на паролата
 	tx, err := db.Begin()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Transaction error"})
 		return
 	}
 
-	// Обновяваме статуса на предизвикателството
-	_, err = tx.Exec(`
-        UPDATE challenges 
-        SET status = 'active' 
-        WHERE id = ?`,
-		challengeID)
-
+	_, err = tx.Exec("UPDATE users SET password = ? WHERE id = ?", string(hashedPassword), targetID)
 	if err != nil {
 		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update challenge"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not reset password"})
 		return
 	}
 
-	// Опитваме се да вземем последното тегло, ако има такова
-	var initialWeight float64
-	err = db.QueryRow(`
-        SELECT weight FROM weight_records 
-        WHERE user_id = ? 
-        ORDER BY created_at DESC LIMIT 1`,
-		userID).Scan(&initialWeight)
-
-	// Записваме началното тегло само ако има такова
-	if err == nil {
-		_, err = tx.Exec(`
-            INSERT INTO challenge_results (challenge_id, user_id, initial_weight) 
-            VALUES (?, ?, ?)`,
-			challengeID, userID, initialWeight)
-
-		if err != nil {
-			tx.Rollback()
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not save initial weight"})
-			return
-		}
+	if err := revokeUserSessions(tx, targetID); err != nil {
+		tx.Rollback()
+		log.Printf("Error revoking sessions: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not revoke sessions"})
+		return
 	}
 
-	tx.Commit()
-	c.JSON(http.StatusOK, gin.H{"message": "Challenge accepted"})
-}
-
-func rejectChallenge(c *gin.Context) {
-	userID := getUserID(c)
-	challengeID := c.Param("challengeId")
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error forcing password reset: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not reset password"})
+		return
+	}
 
-	result, err := db.Exec(`
-        UPDATE challenges 
-        SET status = 'rejected' 
-        WHERE id = ? AND opponent_id = ? AND status = 'pending'`,
-		challengeID, userID)
+	log.Printf("Admin %d forced password reset for user %d", getUserID(c), targetID)
 
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not reject challenge"})
+	if !email.Valid || email.String == "" {
+		c.JSON(http.StatusOK, gin.H{"message": "Password reset forced; the user has no email to receive a reset link"})
 		return
 	}
 
-	rows, _ := result.RowsAffected()
-	if rows == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid challenge"})
+	if err := sendPasswordResetEmail(targetID, email.String); err != nil {
+		log.Printf("Error sending reset email to user %d: %v", targetID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Password reset forced, but the email could not be sent"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Challenge rejected"})
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset forced and reset link sent"})
 }
 
-func getChallenges(c *gin.Context) {
-	userID := getUserID(c)
-
-	// Debug log
-	log.Printf("Fetching challenges for user ID: %d", userID)
+func adminDeleteFriendship(c *gin.Context) {
+	friendshipID := c.Param("friendshipId")
 
-	rows, err := db.Query(`
-        SELECT c.id, c.creator_id, c.opponent_id, c.start_date, c.end_date, c.status, c.created_at,
-               creator.username as creator_name, opponent.username as opponent_name
-        FROM challenges c
-        JOIN users creator ON c.creator_id = creator.id
-        JOIN users opponent ON c.opponent_id = opponent.id
-        WHERE c.creator_id = ? OR c.opponent_id = ?
-        ORDER BY c.created_at DESC
-    `, userID, userID)
+	tx, err := db.Begin()
 	if err != nil {
-		log.Printf("Error querying challenges: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Грешка при зареждане на предизвикателствата"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Transaction error"})
 		return
 	}
-	defer rows.Close()
-
-	var challenges []models.Challenge
-	for rows.Next() {
-		var challenge models.Challenge
-		err := rows.Scan(
-			&challenge.ID,
-			&challenge.CreatorID,
-			&challenge.OpponentID,
-			&challenge.StartDate,
-			&challenge.EndDate,
-			&challenge.Status,
-			&challenge.CreatedAt,
-			&challenge.CreatorName,
-			&challenge.OpponentName,
-		)
-		if err != nil {
-			log.Printf("Error scanning challenge: %v", err)
-			continue
-		}
 
-		// Debug log
-		log.Printf("Loaded challenge: %+v", challenge)
+	_, err = tx.Exec(`
+        INSERT INTO sync_tombstones (user_id, entity, entity_id)
+        SELECT requester_id, 'friendship', id FROM friendships WHERE id = ?
+        UNION ALL
+        SELECT addressee_id, 'friendship', id FROM friendships WHERE id = ?`, friendshipID, friendshipID)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Error recording friendship tombstones: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete friendship"})
+		return
+	}
 
-		challenges = append(challenges, challenge)
+	result, err := tx.Exec("DELETE FROM friendships WHERE id = ?", friendshipID)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Error deleting friendship: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete friendship"})
+		return
 	}
 
-	if err = rows.Err(); err != nil {
-		log.Printf("Error iterating challenges: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Грешка при четене на предизвикателствата"})
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		tx.Rollback()
+		c.JSON(http.StatusNotFound, gin.H{"error": "Friendship not found"})
 		return
 	}
 
-	// Debug log
-	log.Printf("Returning %d challenges", len(challenges))
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete friendship"})
+		return
+	}
 
-	c.JSON(http.StatusOK, challenges)
+	log.Printf("Moderator %d deleted friendship %s", getUserID(c), friendshipID)
+	c.JSON(http.StatusOK, gin.H{"message": "Friendship deleted"})
 }
 
-func getChallengeResults(c *gin.Context) {
-	userID := getUserID(c)
+func adminDeleteChallenge(c *gin.Context) {
 	challengeID := c.Param("challengeId")
 
-	// Проверяваме дали потребителят участва в това предизвикателство
-	var challenge models.Challenge
-	err := db.QueryRow(`
-        SELECT c.id, c.creator_id, c.opponent_id, c.start_date, c.end_date, c.status, c.created_at,
-               u1.username as creator_name, u2.username as opponent_name
-        FROM challenges c
-        JOIN users u1 ON c.creator_id = u1.id
-        JOIN users u2 ON c.opponent_id = u2.id
-        WHERE c.id = ? AND (c.creator_id = ? OR c.opponent_id = ?)`,
-		challengeID, userID, userID).Scan(
-		&challenge.ID, &challenge.CreatorID, &challenge.OpponentID,
-		&challenge.StartDate, &challenge.EndDate, &challenge.Status, &challenge.CreatedAt,
-		&challenge.CreatorName, &challenge.OpponentName)
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Transaction error"})
+		return
+	}
 
+	_, err = tx.Exec(`
+        INSERT INTO sync_tombstones (user_id, entity, entity_id)
+        SELECT creator_id, 'challenge', id FROM challenges WHERE id = ?
+        UNION ALL
+        SELECT opponent_id, 'challenge', id FROM challenges WHERE id = ?`, challengeID, challengeID)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Challenge not found"})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		tx.Rollback()
+		log.Printf("Error recording challenge tombstones: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete challenge"})
 		return
 	}
 
-	// Вземаме резултатите за всеки участник
-	rows, err := db.Query(`
-        WITH user_weights AS (
-            SELECT 
-                u.id as user_id,
-                u.username,
-                COALESCE(
-                    (SELECT weight 
-                     FROM weight_records 
-                     WHERE user_id = u.id 
-                     AND created_at <= ? 
-                     ORDER BY created_at ASC 
-                     LIMIT 1), 0
-                ) as initial_weight,
-                COALESCE(
-                    (SELECT weight 
-                     FROM weight_records 
-                     WHERE user_id = u.id 
-                     AND created_at <= ? 
-                     ORDER BY created_at DESC 
-                     LIMIT 1), 0
-                ) as final_weight
-            FROM users u
-            WHERE u.id IN (?, ?)
-        )
-        SELECT 
-            user_id,
-            username,
-            initial_weight,
-            final_weight,
-            CASE 
-                WHEN initial_weight > 0 AND final_weight > 0 
-                THEN ((initial_weight - final_weight) / initial_weight * 100)
-                ELSE 0 
-            END as progress
-        FROM user_weights`,
-		challenge.EndDate, challenge.EndDate, challenge.CreatorID, challenge.OpponentID)
+	// Първо изтриваме резултатите, които сочат към предизвикателството
+	_, err = tx.Exec("DELETE FROM challenge_results WHERE challenge_id = ?", challengeID)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Error deleting challenge results: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete challenge"})
+		return
+	}
 
+	result, err := tx.Exec("DELETE FROM challenges WHERE id = ?", challengeID)
 	if err != nil {
-		log.Printf("Error fetching results: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch results"})
+		tx.Rollback()
+		log.Printf("Error deleting challenge: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete challenge"})
 		return
 	}
-	defer rows.Close()
 
-	challenge.Results = make([]models.ChallengeResult, 0)
-	for rows.Next() {
-		var result models.ChallengeResult
-		err := rows.Scan(
-			&result.UserID,
-			&result.Username,
-			&result.InitialWeight,
-			&result.FinalWeight,
-			&result.Progress,
-		)
-		if err != nil {
-			log.Printf("Error scanning result: %v", err)
-			continue
-		}
-		result.ChallengeID = challenge.ID
-		challenge.Results = append(challenge.Results, result)
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		tx.Rollback()
+		c.JSON(http.StatusNotFound, gin.H{"error": "Challenge not found"})
+		return
 	}
 
-	log.Printf("Challenge results: %+v", challenge) // Debug log
-	c.JSON(http.StatusOK, challenge)
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete challenge"})
+		return
+	}
+
+	log.Printf("Moderator %d deleted challenge %s", getUserID(c), challengeID)
+	c.JSON(http.StatusOK, gin.H{"message": "Challenge deleted"})
 }
 
-func resetPassword(c *gin.Context) {
-	var req struct {
-		Username string `json:"username"`
+func oidcLogin(c *gin.Context) {
+	if oidcProvider == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "OIDC login is not configured"})
+		return
 	}
 
-	if err := c.BindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+	state, stateHash, err := auth.NewOpaqueToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not start OIDC login"})
 		return
 	}
-
-	// Проверяваме дали потребителят съществува
-	var userID int
-	err := db.QueryRow("SELECT id FROM users WHERE username = ?", req.Username).Scan(&userID)
+	nonce, _, err := auth.NewOpaqueToken()
 	if err != nil {
-		if err == sql.ErrNoRows {
-			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not start OIDC login"})
+		return
+	}
+	verifier, challenge, err := auth.NewPKCE()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not start OIDC login"})
 		return
 	}
 
-	// Генерираме нова случайна парола
-	newPassword := fmt.Sprintf("Reset%d", time.Now().Unix())
-
-	// Хеширане на новата парола
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	err = oidcStates.Save(auth.OIDCLoginState{
+		StateHash:    stateHash,
+		CodeVerifier: verifier,
+		Nonce:        nonce,
+		ExpiresAt:    time.Now().Add(oidcStateTTL),
+	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate new password"})
+		log.Printf("Error saving OIDC state: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not start OIDC login"})
 		return
 	}
 
-	// Обновяваме паролата в базата
-	_, err = db.Exec("UPDATE users SET password = ? WHERE id = ?", string(hashedPassword), userID)
+	redirectURL, err := oidcProvider.AuthCodeURL(c.Request.Context(), state, nonce, challenge)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update password"})
+		log.Printf("Error building OIDC redirect: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Identity provider is unavailable"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"message":     "Password has been reset",
-		"newPassword": newPassword,
-	})
+	// Състоянието се обвързва с браузъра, започнал входа, за да не може чужд
+	// callback адрес да впише жертвата в акаунта на нападателя
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, stateHash, int(oidcStateTTL.Seconds()), oidcCookiePath, "", c.Request.TLS != nil, true)
+
+	c.Redirect(http.StatusFound, redirectURL)
 }
 
-func deleteWeight(c *gin.Context) {
-	userID := getUserID(c)
-	weightID := c.Param("id")
+func oidcCallback(c *gin.Context) {
+	if oidcProvider == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "OIDC login is not configured"})
+		return
+	}
 
-	// Първо проверяваме дали това тегло принадлежи на текущия потребител
-	var ownerID int
-	err := db.QueryRow("SELECT user_id FROM weight_records WHERE id = ?", weightID).Scan(&ownerID)
+	if providerError := c.Query("error"); providerError != "" {
+		log.Printf("OIDC provider returned error: %s", providerError)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login was cancelled or denied"})
+		return
+	}
+
+	state := c.Query("state")
+	code := c.Query("code")
+	if state == "" || code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing state or code"})
+		return
+	}
+
+	cookie, err := c.Cookie(oidcStateCookie)
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, "", -1, oidcCookiePath, "", c.Request.TLS != nil, true)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie), []byte(auth.HashToken(state))) != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired login state"})
+		return
+	}
+
+	// Състоянието е еднократно - хранилището го изтрива при вземане
+	loginState, err := oidcStates.Take(auth.HashToken(state), time.Now())
+	if err == auth.ErrInvalidState {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired login state"})
+		return
+	}
 	if err != nil {
-		if err == sql.ErrNoRows {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Записът не е намерен"})
-			return
-		}
-		log.Printf("Database error: %v", err)
+		log.Printf("Error loading OIDC state: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
 
-	if ownerID != userID {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Нямате право да изтриете този запис"})
+	claims, err := oidcProvider.Exchange(c.Request.Context(), code, loginState.CodeVerifier, loginState.Nonce)
+	if err != nil {
+		log.Printf("OIDC code exchange failed: %v", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Could not verify identity"})
 		return
 	}
 
-	// Изтриваме записа
-	result, err := db.Exec("DELETE FROM weight_records WHERE id = ? AND user_id = ?", weightID, userID)
+	userID, err := auth.ResolveOIDCUser(oidcAccounts, oidcProviderName, claims, isValidEmail)
+	if err == auth.ErrUnverifiedEmail {
+		c.JSON(http.StatusConflict, gin.H{"error": "An account with this email already exists. Verify its email and sign in with your password before using the identity provider."})
+		return
+	}
 	if err != nil {
-		log.Printf("Error deleting weight record: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete weight record"})
+		log.Printf("Error linking OIDC identity: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not link identity"})
 		return
 	}
 
-	rows, _ := result.RowsAffected()
-	if rows == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Записът не е намерен"})
+	var username string
+	var totpEnabled, disabled bool
+	err = db.QueryRow("SELECT username, totp_enabled, disabled_at IS NOT NULL FROM users WHERE id = ?", userID).
+		Scan(&username, &totpEnabled, &disabled)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch user data"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Записът е изтрит успешно"})
+	if disabled {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account disabled"})
+		return
+	}
+
+	// Резултатът се предава на frontend-а във фрагмента на адреса, за да не попада в логове
+	fragment := url.Values{}
+	fragment.Set("userId", strconv.Itoa(userID))
+	fragment.Set("username", username)
+
+	if totpEnabled {
+		challengeToken, _, err := startTwoFactorChallenge(userID)
+		if err != nil {
+			log.Printf("Error starting 2FA challenge: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not start 2FA"})
+			return
+		}
+		fragment.Set("challengeToken", challengeToken)
+		c.Redirect(http.StatusFound, "/#"+fragment.Encode())
+		return
+	}
+
+	session, err := issueSession(db, c, userID)
+	if err != nil {
+		log.Printf("Error creating session: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create session"})
+		return
+	}
+
+	log.Printf("Successful OIDC login for user: %s", username)
+
+	fragment.Set("token", session.Token)
+	fragment.Set("expiresAt", session.ExpiresAt.Format(time.RFC3339))
+	fragment.Set("refreshToken", session.RefreshToken)
+	c.Redirect(http.StatusFound, "/#"+fragment.Encode())
 }
+
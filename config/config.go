@@ -0,0 +1,392 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	EnvDevelopment = "development"
+	EnvProduction  = "production"
+
+	MailDriverFile = "file"
+	MailDriverSMTP = "smtp"
+
+	RateLimitStoreMemory = "memory"
+	RateLimitStoreMySQL  = "mysql"
+
+	// DefaultFile се зарежда, ако съществува и не е зададен друг файл
+	DefaultFile = ".env"
+
+	// placeholderTokenSecret е примерната стойност от по-старите версии на .env
+	placeholderTokenSecret = "change-me-to-a-long-random-secret-value"
+)
+
+// Config съдържа всички настройки на сървъра. Тагът env е името на променливата
+// на средата, а флагът на командния ред е същото име с малки букви и тирета
+// (DB_USER -> -db-user).
+type Config struct {
+	Env    string `yaml:"env" env:"APP_ENV"`
+	APIURL string `yaml:"api_url" env:"API_URL"`
+
+	Server    ServerConfig    `yaml:"server"`
+	Database  DatabaseConfig  `yaml:"database"`
+	Token     TokenConfig     `yaml:"token"`
+	Mail      MailConfig      `yaml:"mail"`
+	Password  PasswordConfig  `yaml:"password"`
+	OIDC      OIDCConfig      `yaml:"oidc"`
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+}
+
+type ServerConfig struct {
+	Port int `yaml:"port" env:"SERVER_PORT"`
+}
+
+type DatabaseConfig struct {
+	User     string `yaml:"user" env:"DB_USER"`
+	Password string `yaml:"password" env:"DB_PASSWORD"`
+	Host     string `yaml:"host" env:"DB_HOST"`
+	Port     int    `yaml:"port" env:"DB_PORT"`
+	Name     string `yaml:"name" env:"DB_NAME"`
+	Charset  string `yaml:"charset" env:"DB_CHARSET"`
+}
+
+type TokenConfig struct {
+	Secret     string        `yaml:"secret" env:"TOKEN_SECRET"`
+	Issuer     string        `yaml:"issuer" env:"TOKEN_ISSUER"`
+	TTL        time.Duration `yaml:"ttl" env:"TOKEN_TTL"`
+	RefreshTTL time.Duration `yaml:"refresh_ttl" env:"REFRESH_TOKEN_TTL"`
+}
+
+type MailConfig struct {
+	Driver               string        `yaml:"driver" env:"MAIL_DRIVER"`
+	Dir                  string        `yaml:"dir" env:"MAIL_DIR"`
+	From                 string        `yaml:"from" env:"MAIL_FROM"`
+	SMTPHost             string        `yaml:"smtp_host" env:"SMTP_HOST"`
+	SMTPPort             int           `yaml:"smtp_port" env:"SMTP_PORT"`
+	SMTPUsername         string        `yaml:"smtp_username" env:"SMTP_USERNAME"`
+	SMTPPassword         string        `yaml:"smtp_password" env:"SMTP_PASSWORD"`
+	PasswordResetTTL     time.Duration `yaml:"password_reset_ttl" env:"PASSWORD_RESET_TTL"`
+	EmailVerificationTTL time.Duration `yaml:"email_verification_ttl" env:"EMAIL_VERIFICATION_TTL"`
+	RequireVerifiedEmail bool          `yaml:"require_verified_email" env:"REQUIRE_VERIFIED_EMAIL"`
+}
+
+type PasswordConfig struct {
+	MinLength      int  `yaml:"min_length" env:"PASSWORD_MIN_LENGTH"`
+	RequireUpper   bool `yaml:"require_upper" env:"PASSWORD_REQUIRE_UPPER"`
+	RequireLower   bool `yaml:"require_lower" env:"PASSWORD_REQUIRE_LOWER"`
+	RequireDigit   bool `yaml:"require_digit" env:"PASSWORD_REQUIRE_DIGIT"`
+	RequireSymbol  bool `yaml:"require_symbol" env:"PASSWORD_REQUIRE_SYMBOL"`
+	RejectUsername bool `yaml:"reject_username" env:"PASSWORD_REJECT_USERNAME"`
+	RejectCommon   bool `yaml:"reject_common" env:"PASSWORD_REJECT_COMMON"`
+}
+
+// OIDCConfig е изключен, ако IssuerURL е празен
+type OIDCConfig struct {
+	ProviderName string `yaml:"provider_name" env:"OIDC_PROVIDER_NAME"`
+	IssuerURL    string `yaml:"issuer_url" env:"OIDC_ISSUER_URL"`
+	ClientID     string `yaml:"client_id" env:"OIDC_CLIENT_ID"`
+	ClientSecret string `yaml:"client_secret" env:"OIDC_CLIENT_SECRET"`
+	RedirectURL  string `yaml:"redirect_url" env:"OIDC_REDIRECT_URL"`
+}
+
+type RateLimitConfig struct {
+	Store            string        `yaml:"store" env:"RATE_LIMIT_STORE"`
+	AuthPerMinute    float64       `yaml:"auth_per_minute" env:"AUTH_RATE_PER_MINUTE"`
+	AuthBurst        int           `yaml:"auth_burst" env:"AUTH_RATE_BURST"`
+	LockoutThreshold int           `yaml:"lockout_threshold" env:"LOCKOUT_THRESHOLD"`
+	LockoutDuration  time.Duration `yaml:"lockout_duration" env:"LOCKOUT_DURATION"`
+}
+
+// Default връща настройките по подразбиране. Данните за базата и тайната за
+// токените нямат стойност по подразбиране и трябва да се зададат.
+func Default() Config {
+	return Config{
+		Env:    EnvProduction,
+		APIURL: "http://localhost:8080",
+		Server: ServerConfig{Port: 8080},
+		Database: DatabaseConfig{
+			Host:    "localhost",
+			Port:    3306,
+			Charset: "utf8mb4",
+		},
+		Token: TokenConfig{
+			Issuer:     "weight-challenge",
+			TTL:        15 * time.Minute,
+			RefreshTTL: 30 * 24 * time.Hour,
+		},
+		Mail: MailConfig{
+			Driver:               MailDriverFile,
+			Dir:                  "logs/mail",
+			From:                 "noreply@weight-challenge.local",
+			SMTPPort:             587,
+			PasswordResetTTL:     time.Hour,
+			EmailVerificationTTL: 48 * time.Hour,
+		},
+		Password: PasswordConfig{
+			MinLength:      8,
+			RejectUsername: true,
+			RejectCommon:   true,
+		},
+		OIDC: OIDCConfig{ProviderName: "oidc"},
+		RateLimit: RateLimitConfig{
+			Store:            RateLimitStoreMemory,
+			AuthPerMinute:    10,
+			AuthBurst:        5,
+			LockoutThreshold: 5,
+			LockoutDuration:  15 * time.Minute,
+		},
+	}
+}
+
+// Error изброява всички липсващи или невалидни настройки наведнъж
+type Error struct {
+	Problems []string
+}
+
+func (e *Error) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// Load събира настройките по реда: стойности по подразбиране, файл (.env или
+// YAML), променливи на средата и флагове от args. Всяка следваща стъпка
+// надделява. Файлът се задава с -config или CONFIG_FILE; без тях се чете .env,
+// само ако съществува. Зададена празна стойност изчиства текстова настройка.
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+	fields := collectFields(&cfg)
+
+	fs := flag.NewFlagSet("weight-challenge", flag.ContinueOnError)
+	configFile := fs.String("config", "", "path to a .env or YAML configuration file")
+	flagValues := make(map[string]*string, len(fields))
+	for _, f := range fields {
+		flagValues[f.env] = fs.String(f.flagName(), "", "overrides "+f.env)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	var problems []string
+
+	path := *configFile
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	if path == "" {
+		if _, err := os.Stat(DefaultFile); err == nil {
+			path = DefaultFile
+		}
+	}
+	if path != "" {
+		problems = append(problems, loadFile(&cfg, fields, path)...)
+	}
+
+	for _, f := range fields {
+		if value, ok := os.LookupEnv(f.env); ok {
+			problems = append(problems, f.set(value)...)
+		}
+	}
+
+	fs.Visit(func(fl *flag.Flag) {
+		for _, f := range fields {
+			if fl.Name == f.flagName() {
+				problems = append(problems, f.set(*flagValues[f.env])...)
+			}
+		}
+	})
+
+	problems = append(problems, cfg.validate()...)
+	if len(problems) > 0 {
+		return nil, &Error{Problems: problems}
+	}
+	return &cfg, nil
+}
+
+// loadFile зарежда YAML по разширението .yaml/.yml, а всичко останало - като .env
+func loadFile(cfg *Config, fields []field, path string) []string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return []string{fmt.Sprintf("config file: %v", err)}
+		}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return []string{fmt.Sprintf("config file %s: %v", path, err)}
+		}
+		return nil
+	}
+
+	values, err := godotenv.Read(path)
+	if err != nil {
+		return []string{fmt.Sprintf("config file: %v", err)}
+	}
+	var problems []string
+	for _, f := range fields {
+		if value, ok := values[f.env]; ok {
+			problems = append(problems, f.set(value)...)
+		}
+	}
+	return problems
+}
+
+func (c *Config) validate() []string {
+	var problems []string
+	require := func(name, value string) {
+		if strings.TrimSpace(value) == "" {
+			problems = append(problems, name+": is required")
+		}
+	}
+	positive := func(name string, ok bool) {
+		if !ok {
+			problems = append(problems, name+": must be positive")
+		}
+	}
+	oneOf := func(name, value string, allowed ...string) {
+		for _, a := range allowed {
+			if value == a {
+				return
+			}
+		}
+		problems = append(problems, fmt.Sprintf("%s: must be one of %s, got %q", name, strings.Join(allowed, ", "), value))
+	}
+	port := func(name string, value int) {
+		if value < 1 || value > 65535 {
+			problems = append(problems, fmt.Sprintf("%s: must be between 1 and 65535, got %d", name, value))
+		}
+	}
+
+	oneOf("APP_ENV", c.Env, EnvDevelopment, EnvProduction)
+	port("SERVER_PORT", c.Server.Port)
+
+	require("DB_USER", c.Database.User)
+	require("DB_HOST", c.Database.Host)
+	require("DB_NAME", c.Database.Name)
+	require("DB_CHARSET", c.Database.Charset)
+	port("DB_PORT", c.Database.Port)
+
+	if len(c.Token.Secret) < 32 {
+		problems = append(problems, "TOKEN_SECRET: must be at least 32 characters")
+	} else if c.Env == EnvProduction && c.Token.Secret == placeholderTokenSecret {
+		problems = append(problems, "TOKEN_SECRET: must not be the example value in production")
+	}
+	positive("TOKEN_TTL", c.Token.TTL > 0)
+	positive("REFRESH_TOKEN_TTL", c.Token.RefreshTTL > 0)
+
+	oneOf("MAIL_DRIVER", c.Mail.Driver, MailDriverFile, MailDriverSMTP)
+	if c.Mail.Driver == MailDriverSMTP {
+		require("SMTP_HOST", c.Mail.SMTPHost)
+		require("MAIL_FROM", c.Mail.From)
+		port("SMTP_PORT", c.Mail.SMTPPort)
+	} else {
+		require("MAIL_DIR", c.Mail.Dir)
+	}
+	positive("PASSWORD_RESET_TTL", c.Mail.PasswordResetTTL > 0)
+	positive("EMAIL_VERIFICATION_TTL", c.Mail.EmailVerificationTTL > 0)
+
+	positive("PASSWORD_MIN_LENGTH", c.Password.MinLength > 0)
+
+	if c.OIDC.IssuerURL != "" {
+		require("OIDC_CLIENT_ID", c.OIDC.ClientID)
+		require("OIDC_REDIRECT_URL", c.OIDC.RedirectURL)
+		require("OIDC_PROVIDER_NAME", c.OIDC.ProviderName)
+	}
+
+	oneOf("RATE_LIMIT_STORE", c.RateLimit.Store, RateLimitStoreMemory, RateLimitStoreMySQL)
+	positive("AUTH_RATE_PER_MINUTE", c.RateLimit.AuthPerMinute > 0)
+	positive("AUTH_RATE_BURST", c.RateLimit.AuthBurst > 0)
+	positive("LOCKOUT_THRESHOLD", c.RateLimit.LockoutThreshold > 0)
+	positive("LOCKOUT_DURATION", c.RateLimit.LockoutDuration > 0)
+
+	return problems
+}
+
+// IsDevelopment връща true в development режим
+func (c *Config) IsDevelopment() bool {
+	return c.Env == EnvDevelopment
+}
+
+// DSN връща адреса за връзка с MySQL. Времената се пазят в UTC независимо от
+// зоната на сървъра.
+func (c *Config) DSN() string {
+	return fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?charset=%s&parseTime=True&loc=UTC&time_zone=%%27%%2B00%%3A00%%27",
+		c.Database.User, c.Database.Password, c.Database.Host, c.Database.Port, c.Database.Name, c.Database.Charset)
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// field е настройка с env таг, до която се стига чрез reflection
+type field struct {
+	env   string
+	value reflect.Value
+}
+
+func (f field) flagName() string {
+	return strings.ToLower(strings.ReplaceAll(f.env, "_", "-"))
+}
+
+// set разчита текстовата стойност според типа на полето. Празна стойност изчиства
+// текстовите настройки, а за числата, булевите и времетраенията се пропуска.
+func (f field) set(raw string) []string {
+	raw = strings.TrimSpace(raw)
+	if raw == "" && f.value.Kind() != reflect.String {
+		return nil
+	}
+	var err error
+	switch {
+	case f.value.Type() == durationType:
+		var d time.Duration
+		if d, err = time.ParseDuration(raw); err == nil {
+			f.value.SetInt(int64(d))
+		}
+	case f.value.Kind() == reflect.String:
+		f.value.SetString(raw)
+	case f.value.Kind() == reflect.Bool:
+		var b bool
+		if b, err = strconv.ParseBool(raw); err == nil {
+			f.value.SetBool(b)
+		}
+	case f.value.Kind() == reflect.Int:
+		var n int64
+		if n, err = strconv.ParseInt(raw, 10, 0); err == nil {
+			f.value.SetInt(n)
+		}
+	case f.value.Kind() == reflect.Float64:
+		var x float64
+		if x, err = strconv.ParseFloat(raw, 64); err == nil {
+			f.value.SetFloat(x)
+		}
+	default:
+		err = errors.New("unsupported setting type")
+	}
+	if err != nil {
+		return []string{fmt.Sprintf("%s: invalid value %q", f.env, raw)}
+	}
+	return nil
+}
+
+func collectFields(cfg *Config) []field {
+	var fields []field
+	var walk func(v reflect.Value)
+	walk = func(v reflect.Value) {
+		for i := 0; i < v.NumField(); i++ {
+			value := v.Field(i)
+			if env := v.Type().Field(i).Tag.Get("env"); env != "" {
+				fields = append(fields, field{env: env, value: value})
+			} else if value.Kind() == reflect.Struct {
+				walk(value)
+			}
+		}
+	}
+	walk(reflect.ValueOf(cfg).Elem())
+	return fields
+}
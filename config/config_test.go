@@ -0,0 +1,177 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+// clearEnv премахва всички настройки от средата за времето на теста
+func clearEnv(t *testing.T) {
+	t.Helper()
+	cfg := Default()
+	names := []string{"CONFIG_FILE"}
+	for _, f := range collectFields(&cfg) {
+		names = append(names, f.env)
+	}
+	for _, name := range names {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	clearEnv(t)
+	path := writeFile(t, "app.env", strings.Join([]string{
+		"DB_USER=file-user",
+		"DB_PASSWORD=file-password",
+		"DB_HOST=file-host",
+		"DB_NAME=file-name",
+		"SERVER_PORT=9000",
+		"TOKEN_SECRET=" + testSecret,
+	}, "\n"))
+
+	t.Setenv("DB_NAME", "env-name")
+	t.Setenv("SERVER_PORT", "9100")
+	t.Setenv("DB_PASSWORD", "")
+
+	cfg, err := Load([]string{"-config", path, "-server-port", "9200"})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	checks := []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"default", cfg.Database.Charset, "utf8mb4"},
+		{"default duration", cfg.Token.TTL, 15 * time.Minute},
+		{"file", cfg.Database.User, "file-user"},
+		{"file", cfg.Database.Host, "file-host"},
+		{"env over file", cfg.Database.Name, "env-name"},
+		{"empty env clears file value", cfg.Database.Password, ""},
+		{"flag over env", cfg.Server.Port, 9200},
+	}
+	for _, c := range checks {
+		if c.got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, c.got, c.want)
+		}
+	}
+}
+
+func TestLoadYAMLFile(t *testing.T) {
+	clearEnv(t)
+	path := writeFile(t, "app.yaml", `
+database:
+  user: yaml-user
+  name: yaml-name
+token:
+  secret: `+testSecret+`
+  ttl: 30m
+rate_limit:
+  store: mysql
+`)
+	t.Setenv("CONFIG_FILE", path)
+
+	cfg, err := Load(nil)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Database.User != "yaml-user" || cfg.Token.TTL != 30*time.Minute || cfg.RateLimit.Store != RateLimitStoreMySQL {
+		t.Errorf("YAML values not applied: %+v", cfg)
+	}
+	if cfg.Database.Host != "localhost" {
+		t.Errorf("default host overwritten: %q", cfg.Database.Host)
+	}
+}
+
+func TestLoadSkipsEmptyTypedValues(t *testing.T) {
+	clearEnv(t)
+	path := writeFile(t, "app.env", "DB_USER=u\nDB_NAME=n\nSERVER_PORT=9000\nTOKEN_SECRET="+testSecret)
+	t.Setenv("SERVER_PORT", "")
+	t.Setenv("TOKEN_TTL", "")
+
+	cfg, err := Load([]string{"-config", path})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Server.Port != 9000 || cfg.Token.TTL != 15*time.Minute {
+		t.Errorf("empty typed values changed settings: port %d, ttl %s", cfg.Server.Port, cfg.Token.TTL)
+	}
+}
+
+func TestLoadReportsAllProblems(t *testing.T) {
+	clearEnv(t)
+	path := writeFile(t, "empty.env", "")
+	t.Setenv("SERVER_PORT", "http")
+	t.Setenv("MAIL_DRIVER", "pigeon")
+	t.Setenv("TOKEN_SECRET", "short")
+
+	_, err := Load([]string{"-config", path, "-token-ttl", "soon"})
+	var cfgErr *Error
+	if !errors.As(err, &cfgErr) {
+		t.Fatalf("Load error = %v, want *Error", err)
+	}
+
+	want := []string{
+		`SERVER_PORT: invalid value "http"`,
+		`TOKEN_TTL: invalid value "soon"`,
+		"DB_USER: is required",
+		"DB_NAME: is required",
+		"TOKEN_SECRET: must be at least 32 characters",
+		"MAIL_DRIVER: must be one of file, smtp",
+	}
+	for _, problem := range want {
+		found := false
+		for _, got := range cfgErr.Problems {
+			if strings.HasPrefix(got, problem) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("missing problem %q in %q", problem, cfgErr.Problems)
+		}
+	}
+}
+
+func TestLoadRejectsPlaceholderSecretInProduction(t *testing.T) {
+	clearEnv(t)
+	path := writeFile(t, "app.env", "DB_USER=u\nDB_NAME=n\nTOKEN_SECRET="+placeholderTokenSecret)
+
+	t.Setenv("APP_ENV", EnvDevelopment)
+	if _, err := Load([]string{"-config", path}); err != nil {
+		t.Fatalf("development Load: %v", err)
+	}
+
+	t.Setenv("APP_ENV", EnvProduction)
+	_, err := Load([]string{"-config", path})
+	var cfgErr *Error
+	if !errors.As(err, &cfgErr) || !strings.HasPrefix(strings.Join(cfgErr.Problems, "\n"), "TOKEN_SECRET:") {
+		t.Fatalf("production Load error = %v, want TOKEN_SECRET problem", err)
+	}
+}
+
+func TestDefaultPasswordPolicy(t *testing.T) {
+	p := Default().Password
+	if p.RequireUpper || p.RequireLower || p.RequireDigit || p.RequireSymbol {
+		t.Errorf("character class rules must be opt-in: %+v", p)
+	}
+	if !p.RejectUsername || !p.RejectCommon {
+		t.Errorf("username and common password checks must be on by default: %+v", p)
+	}
+}
@@ -0,0 +1,176 @@
+package importer
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"weight-challenge/models"
+)
+
+// Row е един ред от импортирания файл. При грешка Err е попълнено,
+// а Weight и CreatedAt може да са празни.
+type Row struct {
+	Line      int
+	Weight    float64
+	CreatedAt time.Time
+	Err       error
+}
+
+// CSVOptions описва формата на CSV файла.
+type CSVOptions struct {
+	// DateFormat е във вида YYYY-MM-DD, DD.MM.YYYY, MM/DD/YYYY HH:mm и т.н.
+	// Празен формат приема RFC3339 или YYYY-MM-DD.
+	DateFormat   string
+	DateColumn   string
+	WeightColumn string
+	// UnitColumn е колона с kg/lb за всеки ред; ако липсва, се ползва DefaultUnit.
+	UnitColumn  string
+	DefaultUnit string
+	Location    *time.Location
+}
+
+var dateTokens = strings.NewReplacer(
+	"YYYY", "2006",
+	"MM", "01",
+	"DD", "02",
+	"HH", "15",
+	"mm", "04",
+	"ss", "05",
+)
+
+// ParseCSV чете CSV със заглавен ред. Грешките по отделните редове не спират
+// обработката - те се връщат в съответния Row.
+func ParseCSV(r io.Reader, opts CSVOptions) ([]Row, error) {
+	if opts.DateColumn == "" {
+		opts.DateColumn = "date"
+	}
+	if opts.WeightColumn == "" {
+		opts.WeightColumn = "weight"
+	}
+	if opts.UnitColumn == "" {
+		opts.UnitColumn = "unit"
+	}
+	if opts.Location == nil {
+		opts.Location = time.UTC
+	}
+	layout := dateTokens.Replace(opts.DateFormat)
+
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		if err == io.EOF {
+			return nil, errors.New("csv file is empty")
+		}
+		return nil, err
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	dateIdx, ok := columns[strings.ToLower(opts.DateColumn)]
+	if !ok {
+		return nil, fmt.Errorf("csv has no %q column", opts.DateColumn)
+	}
+	weightIdx, ok := columns[strings.ToLower(opts.WeightColumn)]
+	if !ok {
+		return nil, fmt.Errorf("csv has no %q column", opts.WeightColumn)
+	}
+	unitIdx, hasUnit := columns[strings.ToLower(opts.UnitColumn)]
+
+	var rows []Row
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			rows = append(rows, Row{Line: line, Err: err})
+			continue
+		}
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+
+		row := Row{Line: line}
+		if dateIdx >= len(record) || weightIdx >= len(record) {
+			row.Err = errors.New("missing columns")
+			rows = append(rows, row)
+			continue
+		}
+
+		unit := opts.DefaultUnit
+		if hasUnit && unitIdx < len(record) && strings.TrimSpace(record[unitIdx]) != "" {
+			unit = record[unitIdx]
+		}
+
+		row.CreatedAt, row.Err = parseDate(strings.TrimSpace(record[dateIdx]), layout, opts.Location)
+		if row.Err == nil {
+			row.Weight, row.Err = parseWeight(record[weightIdx], unit)
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// ParseJSON чете масив от models.WeightRecordInput. Редът е поредният номер в масива.
+// Единицата на записа има предимство пред defaultUnit.
+func ParseJSON(r io.Reader, defaultUnit string) ([]Row, error) {
+	var inputs []models.WeightRecordInput
+	if err := json.NewDecoder(r).Decode(&inputs); err != nil {
+		return nil, fmt.Errorf("invalid json: %w", err)
+	}
+
+	rows := make([]Row, len(inputs))
+	for i, input := range inputs {
+		rows[i].Line = i + 1
+		rows[i].CreatedAt, rows[i].Err = time.Parse(time.RFC3339, input.CreatedAt)
+		if rows[i].Err != nil {
+			rows[i].Err = errors.New("invalid date format")
+			continue
+		}
+		unit := defaultUnit
+		if strings.TrimSpace(input.Unit) != "" {
+			unit = input.Unit
+		}
+		rows[i].Weight, rows[i].Err = models.ToKilograms(input.Weight, unit)
+	}
+	return rows, nil
+}
+
+func parseDate(value, layout string, loc *time.Location) (time.Time, error) {
+	if layout != "" {
+		t, err := time.ParseInLocation(layout, value, loc)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid date %q", value)
+		}
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q", value)
+	}
+	return t, nil
+}
+
+func parseWeight(value, unit string) (float64, error) {
+	// Приемаме и десетична запетая, честа при европейските тракери
+	value = strings.Replace(strings.TrimSpace(value), ",", ".", 1)
+	weight, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid weight %q", value)
+	}
+	return models.ToKilograms(weight, unit)
+}
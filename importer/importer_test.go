@@ -0,0 +1,111 @@
+package importer
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"weight-challenge/models"
+)
+
+func TestParseCSV(t *testing.T) {
+	sofia, err := time.LoadLocation("Europe/Sofia")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+
+	input := strings.Join([]string{
+		"Date,Weight,Unit",
+		"2026-03-01,80.5,",
+		`2026-03-02,"80,5",`,
+		"2026-03-03,176,lbs",
+		"2026-03-04T07:00:00Z,12.5,st",
+		"yesterday,80,",
+		"2026-03-06,heavy,",
+		"2026-03-07,80,oz",
+		"2026-03-08",
+	}, "\n")
+
+	rows, err := ParseCSV(strings.NewReader(input), CSVOptions{DefaultUnit: models.WeightUnitKg, Location: sofia})
+	if err != nil {
+		t.Fatalf("ParseCSV: %v", err)
+	}
+
+	want := []struct {
+		weight  float64
+		date    time.Time
+		invalid bool
+	}{
+		{80.5, time.Date(2026, 3, 1, 0, 0, 0, 0, sofia), false},
+		{80.5, time.Date(2026, 3, 2, 0, 0, 0, 0, sofia), false}, // десетична запетая
+		{176 * models.KilogramsPerPound, time.Date(2026, 3, 3, 0, 0, 0, 0, sofia), false},
+		{12.5 * models.KilogramsPerStone, time.Date(2026, 3, 4, 7, 0, 0, 0, time.UTC), false},
+		{invalid: true}, // непозната дата
+		{invalid: true}, // тегло, което не е число
+		{invalid: true}, // непозната единица
+		{invalid: true}, // липсва колоната с теглото
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("got %d rows, want %d", len(rows), len(want))
+	}
+	for i, w := range want {
+		row := rows[i]
+		if row.Line != i+2 {
+			t.Errorf("row %d: Line = %d, want %d", i, row.Line, i+2)
+		}
+		if w.invalid {
+			if row.Err == nil {
+				t.Errorf("line %d: expected an error", row.Line)
+			}
+			continue
+		}
+		if row.Err != nil {
+			t.Errorf("line %d: %v", row.Line, row.Err)
+			continue
+		}
+		if math.Abs(row.Weight-w.weight) > 1e-9 || !row.CreatedAt.Equal(w.date) {
+			t.Errorf("line %d: got (%v, %s), want (%v, %s)", row.Line, row.Weight, row.CreatedAt, w.weight, w.date)
+		}
+	}
+}
+
+func TestParseCSVDateFormatAndColumns(t *testing.T) {
+	input := "Day,Kilos\n01.03.2026 07:30,\"79,9\"\n03/01/2026,80\n"
+
+	rows, err := ParseCSV(strings.NewReader(input), CSVOptions{
+		DateFormat:   "DD.MM.YYYY HH:mm",
+		DateColumn:   "day",
+		WeightColumn: "kilos",
+		DefaultUnit:  models.WeightUnitKg,
+	})
+	if err != nil {
+		t.Fatalf("ParseCSV: %v", err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("got %d rows, want 2", len(rows))
+	}
+	if rows[0].Err != nil || rows[0].Weight != 79.9 || !rows[0].CreatedAt.Equal(time.Date(2026, 3, 1, 7, 30, 0, 0, time.UTC)) {
+		t.Errorf("line 2: got %+v", rows[0])
+	}
+	// Редът в друг формат е грешен, но не спира останалите
+	if rows[1].Err == nil {
+		t.Errorf("line 3: expected an error for a date in another format")
+	}
+}
+
+func TestParseCSVFileErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"empty file", ""},
+		{"no weight column", "date,kg\n2026-03-01,80\n"},
+		{"no date column", "when,weight\n2026-03-01,80\n"},
+	}
+	for _, tt := range tests {
+		if _, err := ParseCSV(strings.NewReader(tt.input), CSVOptions{}); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
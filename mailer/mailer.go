@@ -0,0 +1,13 @@
+package mailer
+
+// Message е писмо, изпратено от приложението към потребител.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer доставя писма до потребителите.
+type Mailer interface {
+	Send(msg Message) error
+}
@@ -0,0 +1,151 @@
+// Package migrations довежда базата до schema.sql при стартиране на сървъра.
+//
+// schema.sql само създава липсващите таблици, затова колоните и индексите,
+// добавени към вече съществуващи таблици, са изброени тук и се добавят с ALTER TABLE.
+package migrations
+
+import (
+	"database/sql"
+	_ "embed"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+//go:embed schema.sql
+var schema string
+
+type column struct {
+	table      string
+	name       string
+	definition string
+}
+
+type index struct {
+	table      string
+	name       string
+	definition string
+	unique     bool
+}
+
+// Колоните, добавени след първата версия на схемата. Дефинициите съвпадат със schema.sql.
+var columns = []column{
+	{"users", "email_verified_at", "TIMESTAMP NULL DEFAULT NULL"},
+	{"users", "failed_login_attempts", "INT NOT NULL DEFAULT 0"},
+	{"users", "locked_until", "TIMESTAMP NULL DEFAULT NULL"},
+	{"users", "totp_secret", "VARCHAR(64) NULL"},
+	{"users", "totp_enabled", "BOOLEAN NOT NULL DEFAULT false"},
+	{"users", "totp_last_step", "BIGINT NOT NULL DEFAULT 0"},
+	{"users", "recovery_codes", "TEXT NULL"},
+	{"users", "role", "ENUM('user', 'moderator', 'admin') NOT NULL DEFAULT 'user'"},
+	{"users", "disabled_at", "TIMESTAMP NULL DEFAULT NULL"},
+	{"users", "weight_unit", "ENUM('kg', 'lb', 'st') NOT NULL DEFAULT 'kg'"},
+	{"users", "height_unit", "ENUM('cm', 'ftin') NOT NULL DEFAULT 'cm'"},
+	{"users", "timezone", "VARCHAR(64) NOT NULL DEFAULT 'UTC'"},
+	{"users", "daily_policy", "ENUM('first', 'last', 'min', 'average') NOT NULL DEFAULT 'last'"},
+	{"weight_records", "is_outlier", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	{"weight_records", "updated_at", "TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP"},
+	{"weight_records", "deleted_at", "TIMESTAMP NULL DEFAULT NULL"},
+	{"weight_records", "client_id", "VARCHAR(64) NULL"},
+	{"challenges", "updated_at", "TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP"},
+}
+
+var indexes = []index{
+	{"weight_records", "idx_weight_records_user_created", "(user_id, created_at, id)", false},
+	{"weight_records", "idx_weight_records_user_updated", "(user_id, updated_at)", false},
+	{"weight_records", "unique_weight_client", "(user_id, client_id)", true},
+	{"idempotency_keys", "idx_idempotency_keys_created", "(created_at)", false},
+}
+
+// Run създава липсващите таблици и добавя липсващите колони и индекси, след което
+// проверява, че базата поддържа часовите зони на потребителите.
+// Безопасно е да се изпълнява при всяко стартиране и от няколко инстанции едновременно.
+func Run(db *sql.DB) error {
+	for _, statement := range statements(schema) {
+		if _, err := db.Exec(statement); err != nil {
+			return fmt.Errorf("schema: %w", err)
+		}
+	}
+
+	for _, c := range columns {
+		var exists bool
+		err := db.QueryRow(`
+            SELECT EXISTS(SELECT 1 FROM information_schema.COLUMNS
+            WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?)`,
+			c.table, c.name).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.name, c.definition))
+		if err != nil && !isDuplicate(err) {
+			return fmt.Errorf("add column %s.%s: %w", c.table, c.name, err)
+		}
+	}
+
+	for _, i := range indexes {
+		var exists bool
+		err := db.QueryRow(`
+            SELECT EXISTS(SELECT 1 FROM information_schema.STATISTICS
+            WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND INDEX_NAME = ?)`,
+			i.table, i.name).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		kind := "INDEX"
+		if i.unique {
+			kind = "UNIQUE INDEX"
+		}
+		_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD %s %s %s", i.table, kind, i.name, i.definition))
+		if err != nil && !isDuplicate(err) {
+			return fmt.Errorf("add index %s.%s: %w", i.table, i.name, err)
+		}
+	}
+	return checkTimezones(db)
+}
+
+// checkTimezones проверява, че в MySQL са заредени таблиците с часовите зони.
+// Без тях CONVERT_TZ с име на зона връща NULL и дневните тегла не могат да се групират.
+func checkTimezones(db *sql.DB) error {
+	var converted sql.NullString
+	err := db.QueryRow("SELECT CONVERT_TZ('2000-01-01 00:00:00', '+00:00', 'Europe/Sofia')").Scan(&converted)
+	if err != nil {
+		return fmt.Errorf("timezones: %w", err)
+	}
+	if !converted.Valid {
+		return errors.New("timezones: MySQL time zone tables are not loaded (see mysql_tzinfo_to_sql)")
+	}
+	return nil
+}
+
+// statements разделя SQL файла на отделни заявки, защото драйверът не приема няколко наведнъж
+func statements(sqlText string) []string {
+	var lines []string
+	for _, line := range strings.Split(sqlText, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "--") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	var result []string
+	for _, statement := range strings.Split(strings.Join(lines, "\n"), ";") {
+		if statement = strings.TrimSpace(statement); statement != "" {
+			result = append(result, statement)
+		}
+	}
+	return result
+}
+
+// isDuplicate е вярно, когато друга инстанция е добавила колоната или индекса междувременно
+func isDuplicate(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && (mysqlErr.Number == 1060 || mysqlErr.Number == 1061)
+}
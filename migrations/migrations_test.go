@@ -0,0 +1,36 @@
+package migrations
+
+import (
+	"strings"
+	"testing"
+)
+
+// Добавените с ALTER TABLE колони трябва да съвпадат с дефинициите в schema.sql
+func TestColumnsMatchSchema(t *testing.T) {
+	for _, c := range columns {
+		if !strings.Contains(schema, c.name+" "+c.definition+",") {
+			t.Errorf("%s.%s: definition %q not found in schema.sql", c.table, c.name, c.definition)
+		}
+	}
+	for _, i := range indexes {
+		kind := "INDEX "
+		if i.unique {
+			kind = "UNIQUE KEY "
+		}
+		if !strings.Contains(schema, kind+i.name+" "+i.definition) {
+			t.Errorf("%s.%s: index %q not found in schema.sql", i.table, i.name, i.definition)
+		}
+	}
+}
+
+func TestStatementsSkipsComments(t *testing.T) {
+	got := statements("-- a; comment\nCREATE TABLE a (id INT);\n\n-- b\nCREATE TABLE b (id INT); ")
+	if len(got) != 2 || got[0] != "CREATE TABLE a (id INT)" || got[1] != "CREATE TABLE b (id INT)" {
+		t.Fatalf("statements = %q", got)
+	}
+	for _, statement := range statements(schema) {
+		if !strings.HasPrefix(statement, "CREATE TABLE IF NOT EXISTS") {
+			t.Errorf("unexpected statement in schema.sql: %.60q", statement)
+		}
+	}
+}
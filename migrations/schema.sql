@@ -8,6 +8,23 @@ CREATE TABLE IF NOT EXISTS users (
     height FLOAT NOT NULL,
     gender VARCHAR(50),
     email VARCHAR(255) UNIQUE,
+    email_verified_at TIMESTAMP NULL DEFAULT NULL,
+    failed_login_attempts INT NOT NULL DEFAULT 0,
+    locked_until TIMESTAMP NULL DEFAULT NULL,
+    totp_secret VARCHAR(64) NULL,
+    totp_enabled BOOLEAN NOT NULL DEFAULT false,
+    totp_last_step BIGINT NOT NULL DEFAULT 0,
+    recovery_codes TEXT NULL,
+    -- Първият администратор се задава ръчно: UPDATE users SET role = 'admin' WHERE username = '...'
+    role ENUM('user', 'moderator', 'admin') NOT NULL DEFAULT 'user',
+    disabled_at TIMESTAMP NULL DEFAULT NULL,
+    -- Теглата и височината винаги се пазят в kg и cm; това са само единиците за показване
+    weight_unit ENUM('kg', 'lb', 'st') NOT NULL DEFAULT 'kg',
+    height_unit ENUM('cm', 'ftin') NOT NULL DEFAULT 'cm',
+    -- IANA зона за дневните граници; всички TIMESTAMP колони се записват в UTC
+    timezone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+    -- Кое тегло представя деня при няколко записа: първото, последното, най-ниското или средното
+    daily_policy ENUM('first', 'last', 'min', 'average') NOT NULL DEFAULT 'last',
     target_weight FLOAT,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
@@ -17,8 +34,30 @@ CREATE TABLE IF NOT EXISTS weight_records (
     id INT AUTO_INCREMENT PRIMARY KEY,
     user_id INT NOT NULL,
     weight FLOAT NOT NULL,
+    -- Непотвърдена рязка промяна; не участва в статистиката и предизвикателствата
+    is_outlier BOOLEAN NOT NULL DEFAULT FALSE,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-    FOREIGN KEY (user_id) REFERENCES users(id)
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    -- Изтритите записи остават, за да стигне изтриването до офлайн клиентите
+    deleted_at TIMESTAMP NULL DEFAULT NULL,
+    -- Идентификатор от офлайн клиента, по който се разпознава повторно изпратен запис
+    client_id VARCHAR(64) NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    INDEX idx_weight_records_user_created (user_id, created_at, id),
+    INDEX idx_weight_records_user_updated (user_id, updated_at),
+    UNIQUE KEY unique_weight_client (user_id, client_id)
+);
+
+-- Измервания към запис за тегло; мускулната маса е в kg, обиколките - в cm
+CREATE TABLE IF NOT EXISTS body_measurements (
+    weight_record_id INT PRIMARY KEY,
+    body_fat_percent FLOAT NULL,
+    muscle_mass FLOAT NULL,
+    waist FLOAT NULL,
+    hip FLOAT NULL,
+    chest FLOAT NULL,
+    water_percent FLOAT NULL,
+    FOREIGN KEY (weight_record_id) REFERENCES weight_records(id) ON DELETE CASCADE
 );
 
 -- Таблица за настройки за видимост на профила
@@ -50,6 +89,7 @@ CREATE TABLE IF NOT EXISTS challenges (
     end_date TIMESTAMP NOT NULL,
     status ENUM('pending', 'active', 'completed') DEFAULT 'pending',
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
     FOREIGN KEY (creator_id) REFERENCES users(id),
     FOREIGN KEY (opponent_id) REFERENCES users(id)
 );
@@ -64,4 +104,108 @@ CREATE TABLE IF NOT EXISTS challenge_results (
     FOREIGN KEY (challenge_id) REFERENCES challenges(id),
     FOREIGN KEY (user_id) REFERENCES users(id),
     PRIMARY KEY (challenge_id, user_id)
-); 
\ No newline at end of file
+); 
+
+-- Таблица за сесии (refresh токени)
+CREATE TABLE IF NOT EXISTS sessions (
+    id BIGINT PRIMARY KEY AUTO_INCREMENT,
+    user_id INT NOT NULL,
+    refresh_token_hash CHAR(64) NOT NULL UNIQUE,
+    user_agent VARCHAR(255),
+    ip_address VARCHAR(45),
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP NULL DEFAULT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP NULL DEFAULT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    INDEX idx_sessions_user (user_id)
+);
+
+-- Таблица за токени за възстановяване на парола
+CREATE TABLE IF NOT EXISTS password_resets (
+    id INT PRIMARY KEY AUTO_INCREMENT,
+    user_id INT NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP NULL DEFAULT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- Таблица за токени за потвърждение на имейл
+CREATE TABLE IF NOT EXISTS email_verifications (
+    id INT PRIMARY KEY AUTO_INCREMENT,
+    user_id INT NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP NULL DEFAULT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- Таблица за ограничаване на заявките (споделена между инстанциите)
+CREATE TABLE IF NOT EXISTS rate_limits (
+    bucket_key VARCHAR(191) PRIMARY KEY,
+    tokens DOUBLE NOT NULL,
+    updated_at BIGINT NOT NULL
+);
+
+-- Таблица за незавършени входове, чакащи код за двуфакторна автентикация
+CREATE TABLE IF NOT EXISTS two_factor_challenges (
+    id INT PRIMARY KEY AUTO_INCREMENT,
+    user_id INT NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    attempts INT NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP NULL DEFAULT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- Таблица за незавършени OIDC входове (state, PKCE verifier и nonce)
+CREATE TABLE IF NOT EXISTS oidc_states (
+    id INT PRIMARY KEY AUTO_INCREMENT,
+    state_hash CHAR(64) NOT NULL UNIQUE,
+    code_verifier VARCHAR(128) NOT NULL,
+    nonce VARCHAR(64) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Таблица за външни идентичности, свързани с потребителите
+CREATE TABLE IF NOT EXISTS user_identities (
+    id INT PRIMARY KEY AUTO_INCREMENT,
+    user_id INT NOT NULL,
+    provider VARCHAR(64) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(255),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    UNIQUE KEY unique_identity (provider, subject)
+);
+
+-- Таблица за Idempotency-Key: status_code е NULL, докато заявката се изпълнява
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    user_id INT NOT NULL,
+    idempotency_key VARCHAR(255) NOT NULL,
+    request_hash CHAR(64) NOT NULL,
+    status_code INT NULL,
+    content_type VARCHAR(255) NULL,
+    response_body MEDIUMBLOB NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, idempotency_key),
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    INDEX idx_idempotency_keys_created (created_at)
+);
+
+-- Изтрити приятелства и съревнования, за които клиентите научават при синхронизация
+CREATE TABLE IF NOT EXISTS sync_tombstones (
+    id INT PRIMARY KEY AUTO_INCREMENT,
+    user_id INT NOT NULL,
+    entity ENUM('friendship', 'challenge') NOT NULL,
+    entity_id INT NOT NULL,
+    deleted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    INDEX idx_sync_tombstones_user_deleted (user_id, deleted_at)
+);
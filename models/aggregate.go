@@ -0,0 +1,65 @@
+package models
+
+import "time"
+
+const (
+	BucketDay   = "day"
+	BucketWeek  = "week"
+	BucketMonth = "month"
+)
+
+func IsValidBucket(bucket string) bool {
+	switch bucket {
+	case BucketDay, BucketWeek, BucketMonth:
+		return true
+	}
+	return false
+}
+
+// WeightAggregate обобщава записите в един ден, седмица (от понеделник) или месец
+// в зоната на потребителя. End е началото на следващия период. Стойностите са от
+// каноничното тегло на всеки ден, Days е броят дни със записи, а Count - броят записи.
+type WeightAggregate struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	Mean  float64   `json:"mean"`
+	First float64   `json:"first"`
+	Last  float64   `json:"last"`
+	Days  int       `json:"days"`
+	Count int       `json:"count"`
+}
+
+type WeightAggregateReport struct {
+	Bucket      string            `json:"bucket"`
+	Timezone    string            `json:"timezone"`
+	DailyPolicy string            `json:"dailyPolicy"`
+	Unit        string            `json:"unit"`
+	Buckets     []WeightAggregate `json:"buckets"`
+}
+
+// BucketEnd връща началото на периода след този, който започва в start
+func BucketEnd(start time.Time, bucket string) time.Time {
+	switch bucket {
+	case BucketWeek:
+		return start.AddDate(0, 0, 7)
+	case BucketMonth:
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+// ConvertTo преобразува теглата в отчета от килограми в дадената единица
+func (r *WeightAggregateReport) ConvertTo(unit string) {
+	for i := range r.Buckets {
+		b := &r.Buckets[i]
+		b.Min = FromKilograms(b.Min, unit)
+		b.Max = FromKilograms(b.Max, unit)
+		b.Mean = FromKilograms(b.Mean, unit)
+		b.First = FromKilograms(b.First, unit)
+		b.Last = FromKilograms(b.Last, unit)
+	}
+	r.Unit = unit
+}
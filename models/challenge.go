@@ -10,6 +10,7 @@ type Challenge struct {
 	EndDate      time.Time         `json:"endDate"`
 	Status       string            `json:"status"`
 	CreatedAt    time.Time         `json:"createdAt"`
+	UpdatedAt    time.Time         `json:"updatedAt"`
 	CreatorName  string            `json:"creatorName,omitempty"`
 	OpponentName string            `json:"opponentName,omitempty"`
 	Results      []ChallengeResult `json:"results,omitempty"`
@@ -22,4 +23,11 @@ type ChallengeResult struct {
 	InitialWeight float64 `json:"initialWeight"`
 	FinalWeight   float64 `json:"finalWeight"`
 	Progress      float64 `json:"progress"`
+	WeightUnit    string  `json:"weightUnit,omitempty"`
+}
+
+func (r *ChallengeResult) ConvertTo(weightUnit string) {
+	r.InitialWeight = FromKilograms(r.InitialWeight, weightUnit)
+	r.FinalWeight = FromKilograms(r.FinalWeight, weightUnit)
+	r.WeightUnit = weightUnit
 }
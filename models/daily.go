@@ -0,0 +1,34 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+// Правила за каноничното тегло на деня, когато потребителят се е теглил няколко пъти
+const (
+	DailyPolicyFirst   = "first"
+	DailyPolicyLast    = "last"
+	DailyPolicyMin     = "min"
+	DailyPolicyAverage = "average"
+
+	DefaultDailyPolicy = DailyPolicyLast
+)
+
+var ErrInvalidDailyPolicy = errors.New("daily weight policy must be first, last, min or average")
+
+func IsValidDailyPolicy(policy string) bool {
+	switch policy {
+	case DailyPolicyFirst, DailyPolicyLast, DailyPolicyMin, DailyPolicyAverage:
+		return true
+	}
+	return false
+}
+
+// DailyWeight е каноничното тегло за един локален ден. Start е полунощ в зоната
+// на потребителя, а Count - броят записи за деня.
+type DailyWeight struct {
+	Start  time.Time
+	Weight float64
+	Count  int
+}
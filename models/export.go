@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// UserExport съдържа всички данни на потребителя за експорт (GDPR).
+type UserExport struct {
+	ExportedAt    time.Time        `json:"exportedAt"`
+	Profile       User             `json:"profile"`
+	WeightRecords []WeightRecord   `json:"weightRecords"`
+	Friendships   []Friendship     `json:"friendships"`
+	Challenges    []Challenge      `json:"challenges"`
+	Identities    []LinkedIdentity `json:"identities"`
+}
+
+type LinkedIdentity struct {
+	Provider  string    `json:"provider"`
+	Email     string    `json:"email,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
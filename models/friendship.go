@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+type Friendship struct {
+	ID             int       `json:"id"`
+	RequesterID    int       `json:"requesterId"`
+	AddresseeID    int       `json:"addresseeId"`
+	FriendUsername string    `json:"friendUsername"`
+	Status         string    `json:"status"`
+	CreatedAt      time.Time `json:"createdAt"`
+	UpdatedAt      time.Time `json:"updatedAt"`
+}
@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+const (
+	ImportAccepted  = "accepted"
+	ImportRejected  = "rejected"
+	ImportDuplicate = "duplicate"
+)
+
+type ImportRowResult struct {
+	Line      int        `json:"line"`
+	Status    string     `json:"status"`
+	Weight    float64    `json:"weight,omitempty"`
+	CreatedAt *time.Time `json:"createdAt,omitempty"`
+	IsOutlier bool       `json:"isOutlier,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// ImportReport обобщава вноса. Outliers е броят приети редове, отбелязани като отклонения.
+type ImportReport struct {
+	Accepted   int               `json:"accepted"`
+	Rejected   int               `json:"rejected"`
+	Duplicates int               `json:"duplicates"`
+	Outliers   int               `json:"outliers"`
+	Rows       []ImportRowResult `json:"rows"`
+}
@@ -0,0 +1,140 @@
+package models
+
+import "errors"
+
+var ErrMeasurementOutOfRange = errors.New("measurements must be percentages between 1 and 99, muscle mass below body weight and circumferences between 10 and 300 cm")
+
+// BodyMeasurements са незадължителните измервания към запис за тегло.
+// Мускулната маса се пази в kg, а обиколките - в cm. LeanMass и съотношенията
+// се изчисляват при четене и не се записват.
+type BodyMeasurements struct {
+	BodyFatPercent *float64 `json:"bodyFatPercent,omitempty"`
+	MuscleMass     *float64 `json:"muscleMass,omitempty"`
+	Waist          *float64 `json:"waist,omitempty"`
+	Hip            *float64 `json:"hip,omitempty"`
+	Chest          *float64 `json:"chest,omitempty"`
+	WaterPercent   *float64 `json:"waterPercent,omitempty"`
+
+	LeanMass           *float64 `json:"leanMass,omitempty"`
+	WaistToHeightRatio *float64 `json:"waistToHeightRatio,omitempty"`
+	WaistToHipRatio    *float64 `json:"waistToHipRatio,omitempty"`
+}
+
+func (m *BodyMeasurements) IsEmpty() bool {
+	return m == nil || (m.BodyFatPercent == nil && m.MuscleMass == nil && m.Waist == nil &&
+		m.Hip == nil && m.Chest == nil && m.WaterPercent == nil)
+}
+
+// Merge презаписва само полетата, зададени в other
+func (m *BodyMeasurements) Merge(other *BodyMeasurements) {
+	if other == nil {
+		return
+	}
+	for _, field := range []struct{ dst, src **float64 }{
+		{&m.BodyFatPercent, &other.BodyFatPercent},
+		{&m.MuscleMass, &other.MuscleMass},
+		{&m.Waist, &other.Waist},
+		{&m.Hip, &other.Hip},
+		{&m.Chest, &other.Chest},
+		{&m.WaterPercent, &other.WaterPercent},
+	} {
+		if *field.src != nil {
+			*field.dst = *field.src
+		}
+	}
+}
+
+// Validate проверява измерванията в SI спрямо теглото в kg
+func (m *BodyMeasurements) Validate(weight float64) error {
+	if m == nil {
+		return nil
+	}
+	percentOK := func(v *float64) bool { return v == nil || (*v >= 1 && *v <= 99) }
+	circumferenceOK := func(v *float64) bool { return v == nil || (*v >= 10 && *v <= 300) }
+
+	if !percentOK(m.BodyFatPercent) || !percentOK(m.WaterPercent) ||
+		!circumferenceOK(m.Waist) || !circumferenceOK(m.Hip) || !circumferenceOK(m.Chest) {
+		return ErrMeasurementOutOfRange
+	}
+	if m.MuscleMass != nil && (*m.MuscleMass <= 0 || *m.MuscleMass >= weight) {
+		return ErrMeasurementOutOfRange
+	}
+	return nil
+}
+
+// ToSI преобразува мускулната маса в kg и обиколките в cm
+func (m *BodyMeasurements) ToSI(weightUnit, heightUnit string) error {
+	if m == nil {
+		return nil
+	}
+	if m.MuscleMass != nil {
+		kg, err := ToKilograms(*m.MuscleMass, weightUnit)
+		if err != nil {
+			return err
+		}
+		m.MuscleMass = &kg
+	}
+	for _, v := range []**float64{&m.Waist, &m.Hip, &m.Chest} {
+		if *v == nil {
+			continue
+		}
+		cm, err := ToCentimeters(**v, heightUnit)
+		if err != nil {
+			return err
+		}
+		*v = &cm
+	}
+	return nil
+}
+
+// Derive изчислява безмастната маса и съотношенията от тегло в kg и височина в cm
+func (m *BodyMeasurements) Derive(weight, height float64) {
+	if m == nil {
+		return
+	}
+	m.LeanMass, m.WaistToHeightRatio, m.WaistToHipRatio = nil, nil, nil
+	if m.BodyFatPercent != nil {
+		lean := CalculateLeanMass(weight, *m.BodyFatPercent)
+		m.LeanMass = &lean
+	}
+	if m.Waist != nil && height > 0 {
+		ratio := CalculateWaistToHeight(*m.Waist, height)
+		m.WaistToHeightRatio = &ratio
+	}
+	if m.Waist != nil && m.Hip != nil && *m.Hip > 0 {
+		ratio := *m.Waist / *m.Hip
+		m.WaistToHipRatio = &ratio
+	}
+}
+
+// ConvertTo преобразува масите и обиколките от SI в дадените единици
+func (m *BodyMeasurements) ConvertTo(weightUnit, heightUnit string) {
+	if m == nil {
+		return
+	}
+	for _, v := range []**float64{&m.MuscleMass, &m.LeanMass} {
+		if *v != nil {
+			converted := FromKilograms(**v, weightUnit)
+			*v = &converted
+		}
+	}
+	for _, v := range []**float64{&m.Waist, &m.Hip, &m.Chest} {
+		if *v != nil {
+			converted := FromCentimeters(**v, heightUnit)
+			*v = &converted
+		}
+	}
+}
+
+// CalculateLeanMass връща теглото без мазнините
+func CalculateLeanMass(weight, bodyFatPercent float64) float64 {
+	return weight * (1 - bodyFatPercent/100)
+}
+
+// CalculateWaistToHeight връща съотношението талия/височина; над 0.5 се счита за рисково
+func CalculateWaistToHeight(waist, height float64) float64 {
+	if height == 0 {
+		return 0
+	}
+	return waist / height
+}
@@ -0,0 +1,68 @@
+package models
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// MaxDailyChangePercent е промяната спрямо тренда, над която записът е съмнителен
+	MaxDailyChangePercent = 3.0
+	// OutlierLookbackDays е колко назад търсим записи за сравнение
+	OutlierLookbackDays = 14
+)
+
+// OutlierCheck описва сравнението на нов запис с тренда от предишните записи
+type OutlierCheck struct {
+	IsOutlier      bool    `json:"isOutlier"`
+	TrendWeight    float64 `json:"trendWeight,omitempty"`
+	ChangePercent  float64 `json:"changePercent,omitempty"`
+	AllowedPercent float64 `json:"allowedPercent,omitempty"`
+}
+
+// DetectOutlier сравнява теглото с EWMA тренда на предишните записи (подредени
+// от най-стария към най-новия, без отбелязаните като отклонения). Допустимата
+// промяна расте с дните от последния запис. Без предишни записи няма с какво да се сравни.
+func DetectOutlier(weight float64, createdAt time.Time, previous []WeightRecord) OutlierCheck {
+	if len(previous) == 0 {
+		return OutlierCheck{}
+	}
+
+	trend := ComputeTrend(previous, DefaultTrendOptions())
+	reference := trend[len(trend)-1]
+	days := math.Max(1, createdAt.Sub(previous[len(previous)-1].CreatedAt).Hours()/24)
+
+	check := OutlierCheck{
+		TrendWeight:    reference,
+		ChangePercent:  math.Abs(weight-reference) / reference * 100,
+		AllowedPercent: MaxDailyChangePercent * days,
+	}
+	check.IsOutlier = check.ChangePercent > check.AllowedPercent
+	return check
+}
+
+// DetectOutliers проверява няколко нови записа наведнъж, както ако бяха добавени
+// един по един в хронологичен ред: всеки се сравнява със съществуващите и с вече
+// приетите нови записи от последните OutlierLookbackDays дни. existing са без
+// отклоненията, а и двата списъка са подредени от най-стария към най-новия.
+func DetectOutliers(existing, added []WeightRecord) []bool {
+	flags := make([]bool, len(added))
+	var window []WeightRecord
+	next := 0
+	for i, record := range added {
+		for next < len(existing) && existing[next].CreatedAt.Before(record.CreatedAt) {
+			window = append(window, existing[next])
+			next++
+		}
+		since := record.CreatedAt.AddDate(0, 0, -OutlierLookbackDays)
+		for len(window) > 0 && window[0].CreatedAt.Before(since) {
+			window = window[1:]
+		}
+
+		flags[i] = DetectOutlier(record.Weight, record.CreatedAt, window).IsOutlier
+		if !flags[i] {
+			window = append(window, record)
+		}
+	}
+	return flags
+}
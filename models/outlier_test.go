@@ -0,0 +1,45 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDetectOutliersChecksImportedRowsInOrder(t *testing.T) {
+	start := time.Date(2026, 3, 1, 7, 0, 0, 0, time.UTC)
+	day := func(n int) time.Time { return start.AddDate(0, 0, n) }
+
+	existing := []WeightRecord{
+		{Weight: 80, CreatedAt: day(0)},
+		{Weight: 80.2, CreatedAt: day(1)},
+		{Weight: 79.9, CreatedAt: day(2)},
+	}
+	added := []WeightRecord{
+		{Weight: 90, CreatedAt: day(3)},   // рязък скок спрямо тренда
+		{Weight: 80.1, CreatedAt: day(4)}, // сравнява се без отклонението
+		{Weight: 79.8, CreatedAt: day(5)},
+		{Weight: 95, CreatedAt: day(40)}, // предишните записи са извън периода за сравнение
+	}
+
+	want := []bool{true, false, false, false}
+	got := DetectOutliers(existing, added)
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("row %d: outlier = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestDetectOutliersUsesEarlierImportedRows(t *testing.T) {
+	start := time.Date(2026, 3, 1, 7, 0, 0, 0, time.UTC)
+	added := []WeightRecord{
+		{Weight: 80, CreatedAt: start},
+		{Weight: 80.4, CreatedAt: start.AddDate(0, 0, 1)},
+		{Weight: 70, CreatedAt: start.AddDate(0, 0, 2)},
+	}
+
+	got := DetectOutliers(nil, added)
+	if got[0] || got[1] || !got[2] {
+		t.Errorf("DetectOutliers = %v, want [false false true]", got)
+	}
+}
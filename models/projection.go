@@ -0,0 +1,150 @@
+package models
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+const (
+	DefaultProjectionWindow = 28
+	MaxProjectionWindow     = 365
+	// DefaultDeadlineDays е срокът за RequiredWeeklyRate, когато не е зададена дата
+	DefaultDeadlineDays = 12 * 7
+	// Приближение на 95% доверителен интервал за наклона (z вместо t-разпределение)
+	projectionZ = 1.96
+	// Прогноза по-далеч от това е безсмислена
+	maxProjectionDays = 5 * 365
+)
+
+var ErrNotEnoughData = errors.New("at least 3 weight records on different days are needed for a projection")
+
+// WeightProjection е прогнозата кога ще бъде достигнато целевото тегло по
+// линейна регресия върху последните записи. Скоростите са за седмица; отрицателна
+// стойност означава отслабване. Датите липсват, ако с тази скорост целта не се достига.
+type WeightProjection struct {
+	TargetWeight       float64    `json:"targetWeight"`
+	FittedWeight       float64    `json:"fittedWeight"`
+	RemainingWeight    float64    `json:"remainingWeight"`
+	WeeklyRate         float64    `json:"weeklyRate"`
+	WeeklyRateLow      float64    `json:"weeklyRateLow"`
+	WeeklyRateHigh     float64    `json:"weeklyRateHigh"`
+	RequiredWeeklyRate *float64   `json:"requiredWeeklyRate,omitempty"`
+	Reached            bool       `json:"reached"`
+	ProjectedDate      *time.Time `json:"projectedDate,omitempty"`
+	EarliestDate       *time.Time `json:"earliestDate,omitempty"`
+	LatestDate         *time.Time `json:"latestDate,omitempty"`
+	Deadline           *time.Time `json:"deadline,omitempty"`
+	WindowDays         int        `json:"windowDays"`
+	SampleCount        int        `json:"sampleCount"`
+	Unit               string     `json:"unit,omitempty"`
+}
+
+// ProjectWeight прави прогнозата от записи, подредени от най-стария към най-новия
+func ProjectWeight(records []WeightRecord, target float64, windowDays int, now time.Time) (*WeightProjection, error) {
+	if len(records) < 3 {
+		return nil, ErrNotEnoughData
+	}
+
+	origin := records[0].CreatedAt
+	n := float64(len(records))
+	var sumX, sumY float64
+	for _, record := range records {
+		sumX += record.CreatedAt.Sub(origin).Hours() / 24
+		sumY += record.Weight
+	}
+	meanX, meanY := sumX/n, sumY/n
+
+	var sxx, sxy float64
+	for _, record := range records {
+		dx := record.CreatedAt.Sub(origin).Hours()/24 - meanX
+		sxx += dx * dx
+		sxy += dx * (record.Weight - meanY)
+	}
+	if sxx < 1 {
+		// Всички записи са в рамките на ден - наклонът е само шум
+		return nil, ErrNotEnoughData
+	}
+
+	slope := sxy / sxx
+	intercept := meanY - slope*meanX
+
+	var sse float64
+	for _, record := range records {
+		x := record.CreatedAt.Sub(origin).Hours() / 24
+		residual := record.Weight - (intercept + slope*x)
+		sse += residual * residual
+	}
+	slopeError := math.Sqrt(sse / (n - 2) / sxx)
+
+	nowX := now.Sub(origin).Hours() / 24
+	fitted := intercept + slope*nowX
+
+	p := &WeightProjection{
+		TargetWeight:    target,
+		FittedWeight:    fitted,
+		RemainingWeight: fitted - target,
+		WeeklyRate:      slope * 7,
+		WeeklyRateLow:   (slope - projectionZ*slopeError) * 7,
+		WeeklyRateHigh:  (slope + projectionZ*slopeError) * 7,
+		WindowDays:      windowDays,
+		SampleCount:     len(records),
+	}
+
+	if math.Abs(p.RemainingWeight) < 0.05 {
+		p.Reached = true
+		return p, nil
+	}
+
+	p.ProjectedDate = projectDate(now, p.RemainingWeight, slope)
+	// По-бързата скорост дава по-ранна дата; при отслабване това е по-ниската граница
+	fast, slow := p.WeeklyRateLow/7, p.WeeklyRateHigh/7
+	if p.RemainingWeight < 0 {
+		fast, slow = slow, fast
+	}
+	p.EarliestDate = projectDate(now, p.RemainingWeight, fast)
+	p.LatestDate = projectDate(now, p.RemainingWeight, slow)
+	p.SetDeadline(now.AddDate(0, 0, DefaultDeadlineDays), now)
+	return p, nil
+}
+
+// projectDate връща кога remaining ще бъде изминато с дневна скорост slope
+func projectDate(now time.Time, remaining, slope float64) *time.Time {
+	if slope == 0 || (remaining > 0) == (slope > 0) {
+		return nil
+	}
+	days := -remaining / slope
+	if days > maxProjectionDays {
+		return nil
+	}
+	date := now.Add(time.Duration(days * 24 * float64(time.Hour)))
+	return &date
+}
+
+// SetDeadline изчислява нужната седмична скорост, за да се стигне целта до deadline.
+// ProjectWeight я вика с DefaultDeadlineDays; по-късно извикване я заменя.
+func (p *WeightProjection) SetDeadline(deadline, now time.Time) {
+	p.Deadline = &deadline
+	p.RequiredWeeklyRate = nil
+	weeks := deadline.Sub(now).Hours() / (24 * 7)
+	if weeks <= 0 || p.Reached {
+		return
+	}
+	rate := -p.RemainingWeight / weeks
+	p.RequiredWeeklyRate = &rate
+}
+
+// ConvertTo преобразува теглата и скоростите от килограми в дадената единица
+func (p *WeightProjection) ConvertTo(unit string) {
+	p.TargetWeight = FromKilograms(p.TargetWeight, unit)
+	p.FittedWeight = FromKilograms(p.FittedWeight, unit)
+	p.RemainingWeight = FromKilograms(p.RemainingWeight, unit)
+	p.WeeklyRate = FromKilograms(p.WeeklyRate, unit)
+	p.WeeklyRateLow = FromKilograms(p.WeeklyRateLow, unit)
+	p.WeeklyRateHigh = FromKilograms(p.WeeklyRateHigh, unit)
+	if p.RequiredWeeklyRate != nil {
+		rate := FromKilograms(*p.RequiredWeeklyRate, unit)
+		p.RequiredWeeklyRate = &rate
+	}
+	p.Unit = unit
+}
@@ -0,0 +1,124 @@
+package models
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// linearRecords връща по един запис на ден, започвайки от start с дневна промяна rate
+func linearRecords(start time.Time, days int, weight, rate float64) []WeightRecord {
+	records := make([]WeightRecord, days)
+	for i := range records {
+		records[i] = WeightRecord{Weight: weight + rate*float64(i), CreatedAt: start.AddDate(0, 0, i)}
+	}
+	return records
+}
+
+func TestProjectWeight(t *testing.T) {
+	start := time.Date(2026, 3, 1, 7, 0, 0, 0, time.UTC)
+	now := start.AddDate(0, 0, 27)
+
+	tests := []struct {
+		name      string
+		records   []WeightRecord
+		target    float64
+		remaining float64
+		days      float64 // дни до ProjectedDate; 0 - без дата
+		reached   bool
+	}{
+		{"losing toward target", linearRecords(start, 28, 90, -0.1), 80, 7.3, 73, false},
+		{"gaining toward target", linearRecords(start, 28, 60, 0.05), 62.65, -1.3, 26, false},
+		{"trend moving away from target", linearRecords(start, 28, 90, 0.1), 80, 12.7, 0, false},
+		{"already past target and still losing", linearRecords(start, 28, 90, -0.1), 88, -0.7, 0, false},
+		{"target reached", linearRecords(start, 28, 90, -0.1), 87.3, 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := ProjectWeight(tt.records, tt.target, DefaultProjectionWindow, now)
+			if err != nil {
+				t.Fatalf("ProjectWeight: %v", err)
+			}
+			if p.Reached != tt.reached {
+				t.Errorf("Reached = %v, want %v", p.Reached, tt.reached)
+			}
+			if math.Abs(p.RemainingWeight-tt.remaining) > 1e-6 {
+				t.Errorf("RemainingWeight = %.4f, want %.4f", p.RemainingWeight, tt.remaining)
+			}
+			if tt.days == 0 {
+				if p.ProjectedDate != nil {
+					t.Errorf("ProjectedDate = %v, want none", p.ProjectedDate)
+				}
+			} else if p.ProjectedDate == nil || math.Abs(p.ProjectedDate.Sub(now).Hours()/24-tt.days) > 1e-3 {
+				t.Errorf("ProjectedDate = %v, want %v days from now", p.ProjectedDate, tt.days)
+			}
+		})
+	}
+}
+
+func TestProjectWeightConfidenceBounds(t *testing.T) {
+	start := time.Date(2026, 3, 1, 7, 0, 0, 0, time.UTC)
+	records := linearRecords(start, 28, 90, -0.1)
+	for i := range records {
+		if i%2 == 0 {
+			records[i].Weight += 0.3
+		}
+	}
+
+	p, err := ProjectWeight(records, 80, DefaultProjectionWindow, start.AddDate(0, 0, 27))
+	if err != nil {
+		t.Fatalf("ProjectWeight: %v", err)
+	}
+	if !(p.WeeklyRateLow < p.WeeklyRate && p.WeeklyRate < p.WeeklyRateHigh) {
+		t.Errorf("rate %.3f outside bounds [%.3f, %.3f]", p.WeeklyRate, p.WeeklyRateLow, p.WeeklyRateHigh)
+	}
+	// При отслабване по-ниската граница на скоростта дава по-ранната дата
+	if p.EarliestDate == nil || p.ProjectedDate == nil || p.LatestDate == nil ||
+		!p.EarliestDate.Before(*p.ProjectedDate) || !p.ProjectedDate.Before(*p.LatestDate) {
+		t.Errorf("dates not ordered: %v %v %v", p.EarliestDate, p.ProjectedDate, p.LatestDate)
+	}
+}
+
+func TestProjectWeightRequiredRate(t *testing.T) {
+	start := time.Date(2026, 3, 1, 7, 0, 0, 0, time.UTC)
+	now := start.AddDate(0, 0, 27)
+	records := linearRecords(start, 28, 90, -0.1)
+
+	p, err := ProjectWeight(records, 80, DefaultProjectionWindow, now)
+	if err != nil {
+		t.Fatalf("ProjectWeight: %v", err)
+	}
+	if p.RequiredWeeklyRate == nil || math.Abs(*p.RequiredWeeklyRate-(-7.3/12)) > 1e-6 {
+		t.Errorf("default RequiredWeeklyRate = %v, want %.4f", p.RequiredWeeklyRate, -7.3/12)
+	}
+
+	p.SetDeadline(now.AddDate(0, 0, 14), now)
+	if p.RequiredWeeklyRate == nil || math.Abs(*p.RequiredWeeklyRate-(-7.3/2)) > 1e-6 {
+		t.Errorf("RequiredWeeklyRate = %v, want %.4f", p.RequiredWeeklyRate, -7.3/2)
+	}
+
+	p.SetDeadline(now.AddDate(0, 0, -1), now)
+	if p.RequiredWeeklyRate != nil {
+		t.Errorf("RequiredWeeklyRate for past deadline = %v, want none", *p.RequiredWeeklyRate)
+	}
+}
+
+func TestProjectWeightNotEnoughData(t *testing.T) {
+	start := time.Date(2026, 3, 1, 7, 0, 0, 0, time.UTC)
+	sameDay := []WeightRecord{
+		{Weight: 80, CreatedAt: start},
+		{Weight: 79.8, CreatedAt: start.Add(2 * time.Hour)},
+		{Weight: 79.9, CreatedAt: start.Add(4 * time.Hour)},
+	}
+
+	for name, records := range map[string][]WeightRecord{
+		"two records":       linearRecords(start, 2, 80, -0.1),
+		"all on one day":    sameDay,
+		"no records at all": nil,
+	} {
+		if _, err := ProjectWeight(records, 75, DefaultProjectionWindow, start.AddDate(0, 0, 2)); err != ErrNotEnoughData {
+			t.Errorf("%s: err = %v, want ErrNotEnoughData", name, err)
+		}
+	}
+}
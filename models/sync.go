@@ -0,0 +1,152 @@
+package models
+
+import (
+	"encoding/base64"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	SyncActionCreate = "create"
+	SyncActionUpdate = "update"
+	SyncActionDelete = "delete"
+)
+
+// Резултати от прилагането на клиентска промяна
+const (
+	SyncStatusApplied   = "applied"
+	SyncStatusDuplicate = "duplicate"
+	SyncStatusConflict  = "conflict"
+	SyncStatusRejected  = "rejected"
+)
+
+// MaxSyncBatch е максималният брой промени в една заявка към POST /sync
+const MaxSyncBatch = 500
+
+// MaxSyncClientIDLength е размерът на weight_records.client_id
+const MaxSyncClientIDLength = 64
+
+// syncWeightTolerance е разликата в kg, под която две тегла са едно и също -
+// в базата теглата са FLOAT и не се връщат точно както са записани
+const syncWeightTolerance = 0.001
+
+var (
+	ErrInvalidSyncAction = errors.New("action must be create, update or delete")
+	ErrSyncBatchTooLarge = errors.New("too many changes in one sync request")
+	ErrSyncClientID      = errors.New("clientId must be at most 64 characters")
+)
+
+// SyncChanges са промените от последната синхронизация. Изтритите обекти се връщат само с ID.
+type SyncChanges struct {
+	Cursor               string         `json:"cursor"`
+	WeightRecords        []WeightRecord `json:"weightRecords"`
+	DeletedWeightRecords []int          `json:"deletedWeightRecords"`
+	Friendships          []Friendship   `json:"friendships"`
+	DeletedFriendships   []int          `json:"deletedFriendships"`
+	Challenges           []Challenge    `json:"challenges"`
+	DeletedChallenges    []int          `json:"deletedChallenges"`
+}
+
+// WeightChange е промяна по запис, направена на клиента без връзка.
+// ClientID е локалният идентификатор, с който клиентът свързва резултата.
+// BaseUpdatedAt е updatedAt на версията, която клиентът е променил.
+type WeightChange struct {
+	Action        string            `json:"action"`
+	ClientID      string            `json:"clientId,omitempty"`
+	ID            int               `json:"id,omitempty"`
+	Weight        *float64          `json:"weight,omitempty"`
+	CreatedAt     *string           `json:"createdAt,omitempty"`
+	Unit          string            `json:"unit,omitempty"`
+	Measurements  *BodyMeasurements `json:"measurements,omitempty"`
+	Confirm       bool              `json:"confirm,omitempty"`
+	BaseUpdatedAt *time.Time        `json:"baseUpdatedAt,omitempty"`
+}
+
+// Input връща промяната като нов запис
+func (c WeightChange) Input() WeightRecordInput {
+	input := WeightRecordInput{
+		Unit:         c.Unit,
+		Measurements: c.Measurements,
+		Confirm:      c.Confirm,
+	}
+	if c.Weight != nil {
+		input.Weight = *c.Weight
+	}
+	if c.CreatedAt != nil {
+		input.CreatedAt = *c.CreatedAt
+	}
+	return input
+}
+
+// Patch връща промяната като частична редакция на запис
+func (c WeightChange) Patch() WeightRecordPatch {
+	return WeightRecordPatch{
+		Weight:       c.Weight,
+		CreatedAt:    c.CreatedAt,
+		Unit:         c.Unit,
+		Measurements: c.Measurements,
+		Confirm:      c.Confirm,
+	}
+}
+
+// SyncCreateStatus решава какво става със създаване, за което вече има запис
+// със същия clientId или, без clientId, със същото време. existing е nil, ако няма такъв.
+// Повторно изпращане е само запис със същото време и тегло; иначе е конфликт
+// и сървърният запис печели.
+func SyncCreateStatus(existing *WeightRecord, created WeightRecord) string {
+	if existing == nil {
+		return SyncStatusApplied
+	}
+	if existing.CreatedAt.Equal(created.CreatedAt) && math.Abs(existing.Weight-created.Weight) < syncWeightTolerance {
+		return SyncStatusDuplicate
+	}
+	return SyncStatusConflict
+}
+
+// SyncUpdateStatus решава дали редакция на жив запис може да се приложи. Запис,
+// променен на сървъра след base (updatedAt на версията, която клиентът е редактирал),
+// е конфликт и сървърната версия печели. Без base редакцията се прилага безусловно.
+func SyncUpdateStatus(server WeightRecord, base *time.Time) string {
+	// Времената в базата са с точност до секунда
+	if base != nil && server.UpdatedAt.After(base.Truncate(time.Second)) {
+		return SyncStatusConflict
+	}
+	return SyncStatusApplied
+}
+
+type SyncPushRequest struct {
+	WeightRecords []WeightChange `json:"weightRecords"`
+}
+
+// SyncChangeResult е резултатът за една промяна. При конфликт Record е текущата версия на сървъра.
+type SyncChangeResult struct {
+	ClientID string        `json:"clientId,omitempty"`
+	ID       int           `json:"id,omitempty"`
+	Action   string        `json:"action"`
+	Status   string        `json:"status"`
+	Error    string        `json:"error,omitempty"`
+	Record   *WeightRecord `json:"record,omitempty"`
+}
+
+type SyncPushResponse struct {
+	Results []SyncChangeResult `json:"results"`
+}
+
+// EncodeSyncCursor кодира момента на синхронизация. Времената в базата са с точност до секунда.
+func EncodeSyncCursor(t time.Time) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(t.Unix(), 10)))
+}
+
+func DecodeSyncCursor(cursor string) (time.Time, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, ErrInvalidCursor
+	}
+	seconds, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil || seconds < 0 {
+		return time.Time{}, ErrInvalidCursor
+	}
+	return time.Unix(seconds, 0).UTC(), nil
+}
@@ -0,0 +1,59 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSyncCreateStatus(t *testing.T) {
+	at := time.Date(2026, 3, 1, 7, 30, 0, 0, time.UTC)
+	created := WeightRecord{Weight: 72.3, CreatedAt: at}
+
+	tests := []struct {
+		name     string
+		existing *WeightRecord
+		want     string
+	}{
+		{"no existing record", nil, SyncStatusApplied},
+		// FLOAT в базата връща 72.30000305
+		{"resent with the same weight", &WeightRecord{ID: 1, Weight: 72.30000305, CreatedAt: at}, SyncStatusDuplicate},
+		{"same time, different weight", &WeightRecord{ID: 1, Weight: 74.1, CreatedAt: at}, SyncStatusConflict},
+		{"same client id, different time", &WeightRecord{ID: 1, Weight: 72.3, CreatedAt: at.Add(time.Hour)}, SyncStatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SyncCreateStatus(tt.existing, created); got != tt.want {
+				t.Errorf("SyncCreateStatus = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncUpdateStatus(t *testing.T) {
+	updated := time.Date(2026, 3, 1, 7, 30, 0, 0, time.UTC)
+	server := WeightRecord{ID: 1, Weight: 72.3, UpdatedAt: updated}
+	at := func(d time.Duration) *time.Time {
+		t := updated.Add(d)
+		return &t
+	}
+
+	tests := []struct {
+		name string
+		base *time.Time
+		want string
+	}{
+		{"no base version", nil, SyncStatusApplied},
+		{"edited the current version", at(0), SyncStatusApplied},
+		// Клиентът пази времето с милисекунди, а базата - с точност до секунда
+		{"base with sub-second precision", at(400 * time.Millisecond), SyncStatusApplied},
+		{"edited a newer local copy", at(time.Minute), SyncStatusApplied},
+		{"server changed after base", at(-time.Second), SyncStatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SyncUpdateStatus(server, tt.base); got != tt.want {
+				t.Errorf("SyncUpdateStatus = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
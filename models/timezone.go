@@ -0,0 +1,40 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+const DefaultTimezone = "UTC"
+
+var ErrInvalidTimezone = errors.New("timezone must be an IANA name such as Europe/Sofia")
+
+// LoadTimezone зарежда IANA часова зона. "Local" не се приема, защото зависи от сървъра.
+func LoadTimezone(name string) (*time.Location, error) {
+	if name == "" {
+		name = DefaultTimezone
+	}
+	if name == "Local" {
+		return nil, ErrInvalidTimezone
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, ErrInvalidTimezone
+	}
+	return loc, nil
+}
+
+// StartOfDay връща началото на календарния ден на t в дадената зона
+func StartOfDay(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
+
+// CalendarDay тълкува датата на t такава, каквато е записана (без преобразуване
+// на зоната), като ден в loc. Така "2024-03-01T00:00:00Z" е 1 март за всеки потребител.
+func CalendarDay(t time.Time, loc *time.Location) (start, end time.Time) {
+	start = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	// TIMESTAMP пази цели секунди, затова краят е последната секунда от деня
+	end = start.AddDate(0, 0, 1).Add(-time.Second)
+	return start, end
+}
@@ -0,0 +1,89 @@
+package models
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+const (
+	TrendEWMA = "ewma"
+	TrendSMA  = "sma"
+
+	// DefaultTrendSmoothing е 10% на ден, както в The Hacker's Diet
+	DefaultTrendSmoothing = 0.1
+	DefaultTrendWindow    = 7
+	MaxTrendWindow        = 365
+)
+
+var ErrInvalidTrendOptions = errors.New("trend must be ewma or sma, smoothing between 0 and 1 and window between 1 and 365 days")
+
+// TrendOptions избира метода за изглаждане. Smoothing се ползва от EWMA,
+// Window (в дни) - от SMA.
+type TrendOptions struct {
+	Method    string
+	Smoothing float64
+	Window    int
+}
+
+func DefaultTrendOptions() TrendOptions {
+	return TrendOptions{Method: TrendEWMA, Smoothing: DefaultTrendSmoothing, Window: DefaultTrendWindow}
+}
+
+func (o TrendOptions) Validate() error {
+	switch {
+	case o.Method != TrendEWMA && o.Method != TrendSMA:
+		return ErrInvalidTrendOptions
+	case o.Smoothing <= 0 || o.Smoothing > 1:
+		return ErrInvalidTrendOptions
+	case o.Window < 1 || o.Window > MaxTrendWindow:
+		return ErrInvalidTrendOptions
+	}
+	return nil
+}
+
+// ComputeTrend връща изгладеното тегло за всеки запис. Записите трябва да са
+// подредени от най-стария към най-новия.
+func ComputeTrend(records []WeightRecord, opts TrendOptions) []float64 {
+	if opts.Method == TrendSMA {
+		return simpleMovingAverage(records, opts.Window)
+	}
+	return exponentialMovingAverage(records, opts.Smoothing)
+}
+
+// exponentialMovingAverage прилага trend += alpha * (weight - trend) за всеки ден.
+// При пропуснати дни коефициентът се натрупва, а при няколко записа в един ден
+// всеки получава съответната част от деня.
+func exponentialMovingAverage(records []WeightRecord, smoothing float64) []float64 {
+	trend := make([]float64, len(records))
+	for i, record := range records {
+		if i == 0 {
+			trend[i] = record.Weight
+			continue
+		}
+		days := record.CreatedAt.Sub(records[i-1].CreatedAt).Hours() / 24
+		alpha := smoothing
+		if days > 0 {
+			alpha = 1 - math.Pow(1-smoothing, days)
+		}
+		trend[i] = trend[i-1] + alpha*(record.Weight-trend[i-1])
+	}
+	return trend
+}
+
+// simpleMovingAverage осреднява записите от последните window дни до всеки запис
+func simpleMovingAverage(records []WeightRecord, window int) []float64 {
+	trend := make([]float64, len(records))
+	span := time.Duration(window) * 24 * time.Hour
+	start := 0
+	sum := 0.0
+	for i, record := range records {
+		sum += record.Weight
+		for record.CreatedAt.Sub(records[start].CreatedAt) >= span {
+			sum -= records[start].Weight
+			start++
+		}
+		trend[i] = sum / float64(i-start+1)
+	}
+	return trend
+}
@@ -0,0 +1,69 @@
+package models
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestExponentialMovingAverage(t *testing.T) {
+	start := time.Date(2026, 3, 1, 7, 0, 0, 0, time.UTC)
+	records := []WeightRecord{
+		{Weight: 80, CreatedAt: start},
+		{Weight: 81, CreatedAt: start.AddDate(0, 0, 1)},
+		{Weight: 79, CreatedAt: start.AddDate(0, 0, 4)},                     // три дни по-късно
+		{Weight: 80, CreatedAt: start.AddDate(0, 0, 4).Add(12 * time.Hour)}, // половин ден по-късно
+		{Weight: 82, CreatedAt: start.AddDate(0, 0, 4).Add(12 * time.Hour)}, // същото време
+	}
+
+	want := make([]float64, len(records))
+	want[0] = 80
+	want[1] = 80 + 0.1*(81-80)
+	want[2] = want[1] + (1-math.Pow(0.9, 3))*(79-want[1])
+	want[3] = want[2] + (1-math.Pow(0.9, 0.5))*(80-want[2])
+	want[4] = want[3] + 0.1*(82-want[3])
+
+	got := ComputeTrend(records, DefaultTrendOptions())
+	for i := range want {
+		if math.Abs(got[i]-want[i]) > 1e-9 {
+			t.Errorf("record %d: trend = %.6f, want %.6f", i, got[i], want[i])
+		}
+	}
+}
+
+func TestSimpleMovingAverage(t *testing.T) {
+	start := time.Date(2026, 3, 1, 7, 0, 0, 0, time.UTC)
+	records := []WeightRecord{
+		{Weight: 80, CreatedAt: start},
+		{Weight: 82, CreatedAt: start.AddDate(0, 0, 1)},
+		{Weight: 84, CreatedAt: start.AddDate(0, 0, 2)},
+		{Weight: 90, CreatedAt: start.AddDate(0, 0, 10)},
+	}
+
+	got := ComputeTrend(records, TrendOptions{Method: TrendSMA, Window: 2})
+	want := []float64{80, 81, 83, 90}
+	for i := range want {
+		if math.Abs(got[i]-want[i]) > 1e-9 {
+			t.Errorf("record %d: trend = %.6f, want %.6f", i, got[i], want[i])
+		}
+	}
+}
+
+func TestTrendOptionsValidate(t *testing.T) {
+	tests := []struct {
+		opts  TrendOptions
+		valid bool
+	}{
+		{DefaultTrendOptions(), true},
+		{TrendOptions{Method: TrendSMA, Smoothing: 1, Window: MaxTrendWindow}, true},
+		{TrendOptions{Method: "median", Smoothing: 0.1, Window: 7}, false},
+		{TrendOptions{Method: TrendEWMA, Smoothing: 0, Window: 7}, false},
+		{TrendOptions{Method: TrendEWMA, Smoothing: 1.5, Window: 7}, false},
+		{TrendOptions{Method: TrendSMA, Smoothing: 0.1, Window: 0}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.opts.Validate(); (err == nil) != tt.valid {
+			t.Errorf("Validate(%+v) = %v, want valid %v", tt.opts, err, tt.valid)
+		}
+	}
+}
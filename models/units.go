@@ -0,0 +1,99 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	WeightUnitKg = "kg"
+	WeightUnitLb = "lb"
+	WeightUnitSt = "st"
+
+	HeightUnitCm = "cm"
+	// HeightUnitFtIn е стойност в инчове, която клиентите показват като футове и инчове
+	HeightUnitFtIn = "ftin"
+)
+
+const (
+	KilogramsPerPound  = 0.45359237
+	KilogramsPerStone  = 14 * KilogramsPerPound
+	CentimetersPerInch = 2.54
+)
+
+// NormalizeUnit приема и често срещани варианти като "lbs" или "ft-in"
+func NormalizeUnit(unit string) string {
+	switch unit = strings.ToLower(strings.TrimSpace(unit)); unit {
+	case "kgs":
+		return WeightUnitKg
+	case "lbs":
+		return WeightUnitLb
+	case "stone":
+		return WeightUnitSt
+	case "ft-in", "in":
+		return HeightUnitFtIn
+	}
+	return unit
+}
+
+func IsValidWeightUnit(unit string) bool {
+	switch NormalizeUnit(unit) {
+	case WeightUnitKg, WeightUnitLb, WeightUnitSt:
+		return true
+	}
+	return false
+}
+
+func IsValidHeightUnit(unit string) bool {
+	switch NormalizeUnit(unit) {
+	case HeightUnitCm, HeightUnitFtIn:
+		return true
+	}
+	return false
+}
+
+// ToKilograms преобразува тегло от дадената мерна единица в килограми.
+// Празна единица означава килограми.
+func ToKilograms(value float64, unit string) (float64, error) {
+	switch NormalizeUnit(unit) {
+	case "", WeightUnitKg:
+		return value, nil
+	case WeightUnitLb:
+		return value * KilogramsPerPound, nil
+	case WeightUnitSt:
+		return value * KilogramsPerStone, nil
+	default:
+		return 0, fmt.Errorf("unknown weight unit %q", unit)
+	}
+}
+
+// FromKilograms преобразува тегло в килограми към дадената мерна единица
+func FromKilograms(kg float64, unit string) float64 {
+	switch NormalizeUnit(unit) {
+	case WeightUnitLb:
+		return kg / KilogramsPerPound
+	case WeightUnitSt:
+		return kg / KilogramsPerStone
+	default:
+		return kg
+	}
+}
+
+// ToCentimeters преобразува височина в сантиметри. Празна единица означава сантиметри.
+func ToCentimeters(value float64, unit string) (float64, error) {
+	switch NormalizeUnit(unit) {
+	case "", HeightUnitCm:
+		return value, nil
+	case HeightUnitFtIn:
+		return value * CentimetersPerInch, nil
+	default:
+		return 0, fmt.Errorf("unknown height unit %q", unit)
+	}
+}
+
+func FromCentimeters(cm float64, unit string) float64 {
+	if NormalizeUnit(unit) == HeightUnitFtIn {
+		return cm / CentimetersPerInch
+	}
+	return cm
+}
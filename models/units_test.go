@@ -0,0 +1,88 @@
+package models
+
+import (
+	"math"
+	"testing"
+)
+
+func TestWeightUnits(t *testing.T) {
+	tests := []struct {
+		unit  string
+		value float64
+		kg    float64
+	}{
+		{"", 80, 80},
+		{"kg", 80, 80},
+		{"KGS", 80, 80},
+		{"lb", 176, 79.83225712},
+		{" lbs ", 1, KilogramsPerPound},
+		{"st", 12.5, 79.37866475},
+		{"stone", 1, 6.35029318},
+	}
+
+	for _, tt := range tests {
+		kg, err := ToKilograms(tt.value, tt.unit)
+		if err != nil {
+			t.Errorf("ToKilograms(%v, %q): %v", tt.value, tt.unit, err)
+			continue
+		}
+		if math.Abs(kg-tt.kg) > 1e-6 {
+			t.Errorf("ToKilograms(%v, %q) = %v, want %v", tt.value, tt.unit, kg, tt.kg)
+		}
+		if back := FromKilograms(kg, tt.unit); math.Abs(back-tt.value) > 1e-9 {
+			t.Errorf("FromKilograms(%v, %q) = %v, want %v", kg, tt.unit, back, tt.value)
+		}
+	}
+
+	if _, err := ToKilograms(80, "oz"); err == nil {
+		t.Error("ToKilograms accepted an unknown unit")
+	}
+}
+
+func TestHeightUnits(t *testing.T) {
+	tests := []struct {
+		unit  string
+		value float64
+		cm    float64
+	}{
+		{"", 180, 180},
+		{"cm", 180, 180},
+		{"ftin", 70, 177.8}, // 5 ft 10 in
+		{"ft-in", 72, 182.88},
+		{"in", 1, CentimetersPerInch},
+	}
+
+	for _, tt := range tests {
+		cm, err := ToCentimeters(tt.value, tt.unit)
+		if err != nil {
+			t.Errorf("ToCentimeters(%v, %q): %v", tt.value, tt.unit, err)
+			continue
+		}
+		if math.Abs(cm-tt.cm) > 1e-9 {
+			t.Errorf("ToCentimeters(%v, %q) = %v, want %v", tt.value, tt.unit, cm, tt.cm)
+		}
+		if back := FromCentimeters(cm, tt.unit); math.Abs(back-tt.value) > 1e-9 {
+			t.Errorf("FromCentimeters(%v, %q) = %v, want %v", cm, tt.unit, back, tt.value)
+		}
+	}
+
+	if _, err := ToCentimeters(180, "m"); err == nil {
+		t.Error("ToCentimeters accepted an unknown unit")
+	}
+}
+
+func TestUnitValidation(t *testing.T) {
+	for _, unit := range []string{"kg", "lbs", "St"} {
+		if !IsValidWeightUnit(unit) {
+			t.Errorf("IsValidWeightUnit(%q) = false", unit)
+		}
+	}
+	for _, unit := range []string{"", "cm", "oz"} {
+		if IsValidWeightUnit(unit) {
+			t.Errorf("IsValidWeightUnit(%q) = true", unit)
+		}
+	}
+	if !IsValidHeightUnit("ft-in") || IsValidHeightUnit("kg") {
+		t.Error("IsValidHeightUnit accepts the wrong units")
+	}
+}
@@ -1,5 +1,29 @@
 package models
 
+import "time"
+
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+var roleRanks = map[string]int{
+	RoleUser:      1,
+	RoleModerator: 2,
+	RoleAdmin:     3,
+}
+
+func IsValidRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// HasRole проверява дали role е равна на required или я превъзхожда
+func HasRole(role, required string) bool {
+	return IsValidRole(role) && roleRanks[role] >= roleRanks[required]
+}
+
 type User struct {
 	ID        int     `json:"id"`
 	Username  string  `json:"username"`
@@ -12,6 +36,22 @@ type User struct {
 	Email     string  `json:"email,omitempty"`
 	Target    float64 `json:"target,omitempty"`
 	IsVisible bool    `json:"isVisible,omitempty"`
+
+	EmailVerified bool   `json:"emailVerified"`
+	Role          string `json:"role,omitempty"`
+	WeightUnit    string `json:"weightUnit,omitempty"`
+	HeightUnit    string `json:"heightUnit,omitempty"`
+	Timezone      string `json:"timezone,omitempty"`
+	// DailyPolicy избира каноничното тегло на деня при няколко записа (first, last, min, average)
+	DailyPolicy string `json:"dailyPolicy,omitempty"`
+}
+
+// ConvertTo преобразува височината и целевото тегло от SI към дадените единици
+func (u *User) ConvertTo(weightUnit, heightUnit string) {
+	u.Height = FromCentimeters(u.Height, heightUnit)
+	u.Target = FromKilograms(u.Target, weightUnit)
+	u.WeightUnit = weightUnit
+	u.HeightUnit = heightUnit
 }
 
 type UserProfile struct {
@@ -19,4 +59,21 @@ type UserProfile struct {
 	Username string  `json:"username"`
 	Height   float64 `json:"height"`
 	Progress float64 `json:"progress"`
+
+	HeightUnit string `json:"heightUnit,omitempty"`
+}
+
+func (p *UserProfile) ConvertTo(heightUnit string) {
+	p.Height = FromCentimeters(p.Height, heightUnit)
+	p.HeightUnit = heightUnit
+}
+
+type AdminUser struct {
+	ID            int       `json:"id"`
+	Username      string    `json:"username"`
+	Email         string    `json:"email,omitempty"`
+	Role          string    `json:"role"`
+	EmailVerified bool      `json:"emailVerified"`
+	Disabled      bool      `json:"disabled"`
+	CreatedAt     time.Time `json:"createdAt"`
 }
@@ -1,17 +1,83 @@
 package models
 
-import "time"
+import (
+	"errors"
+	"time"
+)
 
 type WeightRecord struct {
 	ID        int       `json:"id"`
 	UserID    int       `json:"userId"`
 	Weight    float64   `json:"weight"`
 	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	Unit      string    `json:"unit,omitempty"`
+
+	TrendWeight  float64           `json:"trendWeight,omitempty"`
+	Measurements *BodyMeasurements `json:"measurements,omitempty"`
+
+	// IsOutlier е рязка промяна спрямо тренда, която не е потвърдена. Такива записи
+	// се показват в историята, но не участват в статистиката и предизвикателствата.
+	IsOutlier bool `json:"isOutlier"`
+
+	// ClientID е идентификаторът от офлайн клиента, с който е създаден записът
+	ClientID string `json:"-"`
 }
 
+// WeightRecordInput е нов запис; Unit е kg, lb или st (по подразбиране - предпочитаната единица)
+// Мускулната маса в Measurements е в единицата за тегло, а обиколките - в предпочитаната единица за височина.
 type WeightRecordInput struct {
-	Weight    float64 `json:"weight"`
-	CreatedAt string  `json:"createdAt"`
+	Weight       float64           `json:"weight"`
+	CreatedAt    string            `json:"createdAt"`
+	Unit         string            `json:"unit,omitempty"`
+	Measurements *BodyMeasurements `json:"measurements,omitempty"`
+	// Confirm потвърждава рязка промяна, за да не се отбележи като отклонение
+	Confirm bool `json:"confirm,omitempty"`
+}
+
+// WeightRecordPatch е частична промяна на запис - липсващите полета не се променят
+type WeightRecordPatch struct {
+	Weight       *float64          `json:"weight"`
+	CreatedAt    *string           `json:"createdAt"`
+	Unit         string            `json:"unit,omitempty"`
+	Measurements *BodyMeasurements `json:"measurements,omitempty"`
+	Confirm      bool              `json:"confirm,omitempty"`
+}
+
+const (
+	MinWeight = 20.0
+	MaxWeight = 500.0
+)
+
+var (
+	ErrWeightOutOfRange = errors.New("weight must be between 20 and 500 kg")
+	ErrDateInFuture     = errors.New("date cannot be in the future")
+)
+
+// ValidateWeightRecord проверява стойността и датата на запис за тегло
+func ValidateWeightRecord(weight float64, createdAt, now time.Time) error {
+	if weight < MinWeight || weight > MaxWeight {
+		return ErrWeightOutOfRange
+	}
+	// Допускаме малко разминаване в часовника на клиента
+	if createdAt.After(now.Add(5 * time.Minute)) {
+		return ErrDateInFuture
+	}
+	return nil
+}
+
+type WeightExportRow struct {
+	ID        int       `json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	Weight    float64   `json:"weight"`
+	BMI       float64   `json:"bmi"`
+	Progress  float64   `json:"progress"`
+	Unit      string    `json:"unit"`
+}
+
+type WeightHistoryPage struct {
+	Records    []WeightRecord `json:"records"`
+	NextCursor string         `json:"nextCursor,omitempty"`
 }
 
 type WeightStats struct {
@@ -22,7 +88,78 @@ type WeightStats struct {
 	DailyProgress  float64        `json:"dailyProgress"`
 	BMI            float64        `json:"bmi"`
 	Height         float64        `json:"height"`
-	History        []WeightRecord `json:"history"`
+	History        []WeightRecord `json:"history,omitempty"`
+	RecordCount    int            `json:"recordCount"`
+	From           *time.Time     `json:"from,omitempty"`
+	To             *time.Time     `json:"to,omitempty"`
+	WeightUnit     string         `json:"weightUnit"`
+	HeightUnit     string         `json:"heightUnit"`
+
+	// Началното, текущото и предишното тегло са каноничните за съответния ден според DailyPolicy
+	DailyPolicy string `json:"dailyPolicy"`
+
+	// Изгладеното тегло не се влияе от дневните колебания във водата
+	TrendWeight   float64 `json:"trendWeight"`
+	TrendProgress float64 `json:"trendProgress"`
+	TrendMethod   string  `json:"trendMethod"`
+
+	// Projection липсва, ако няма зададено целево тегло или записите са твърде малко
+	Projection *WeightProjection `json:"projection,omitempty"`
+
+	// Measurements са измерванията от последния запис с производните показатели
+	Measurements *BodyMeasurements `json:"measurements,omitempty"`
+}
+
+// ApplyTrend попълва trendWeight на всеки запис и обобщението в статистиката.
+// records трябва да са подредени от най-стария към най-новия; отклоненията се пропускат.
+func (s *WeightStats) ApplyTrend(records []WeightRecord, opts TrendOptions) {
+	s.TrendMethod = opts.Method
+
+	var valid []WeightRecord
+	var positions []int
+	for i, record := range records {
+		if !record.IsOutlier {
+			valid = append(valid, record)
+			positions = append(positions, i)
+		}
+	}
+	if len(valid) == 0 {
+		return
+	}
+
+	trend := ComputeTrend(valid, opts)
+	for i, position := range positions {
+		records[position].TrendWeight = trend[i]
+	}
+	s.TrendWeight = trend[len(trend)-1]
+	s.TrendProgress = CalculateProgress(trend[0], s.TrendWeight)
+}
+
+// ConvertTo преобразува записа и измерванията към него от SI в дадените единици
+func (r *WeightRecord) ConvertTo(weightUnit, heightUnit string) {
+	r.Weight = FromKilograms(r.Weight, weightUnit)
+	r.TrendWeight = FromKilograms(r.TrendWeight, weightUnit)
+	r.Measurements.ConvertTo(weightUnit, heightUnit)
+	r.Unit = weightUnit
+}
+
+// ConvertTo преобразува теглата и височината от SI към дадените единици.
+// BMI и процентите за прогрес не зависят от единиците.
+func (s *WeightStats) ConvertTo(weightUnit, heightUnit string) {
+	s.CurrentWeight = FromKilograms(s.CurrentWeight, weightUnit)
+	s.InitialWeight = FromKilograms(s.InitialWeight, weightUnit)
+	s.PreviousWeight = FromKilograms(s.PreviousWeight, weightUnit)
+	s.TrendWeight = FromKilograms(s.TrendWeight, weightUnit)
+	s.Height = FromCentimeters(s.Height, heightUnit)
+	if s.Projection != nil {
+		s.Projection.ConvertTo(weightUnit)
+	}
+	for i := range s.History {
+		s.History[i].ConvertTo(weightUnit, heightUnit)
+	}
+	s.Measurements.ConvertTo(weightUnit, heightUnit)
+	s.WeightUnit = weightUnit
+	s.HeightUnit = heightUnit
 }
 
 func CalculateProgress(initialWeight, currentWeight float64) float64 {
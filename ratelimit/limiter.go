@@ -0,0 +1,49 @@
+package ratelimit
+
+import (
+	"math"
+	"time"
+)
+
+// Store пази състоянието на кофите на token bucket лимитера.
+type Store interface {
+	Take(key string, rate, burst float64, now time.Time) (allowed bool, retryAfter time.Duration, err error)
+}
+
+// Limiter ограничава броя заявки за даден ключ (IP адрес, потребител и т.н.).
+type Limiter struct {
+	store Store
+	rate  float64
+	burst float64
+}
+
+// NewLimiter позволява perMinute заявки на минута с натрупване до burst.
+func NewLimiter(store Store, perMinute float64, burst int) *Limiter {
+	return &Limiter{store: store, rate: perMinute / 60, burst: float64(burst)}
+}
+
+func (l *Limiter) Allow(key string) (bool, time.Duration, error) {
+	return l.store.Take(key, l.rate, l.burst, time.Now())
+}
+
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// take допълва кофата според изминалото време и опитва да вземе един токен.
+func (b *bucket) take(rate, burst float64, now time.Time) (bool, time.Duration) {
+	elapsed := now.Sub(b.updatedAt).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(burst, b.tokens+elapsed*rate)
+	}
+	b.updatedAt = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	return false, wait
+}
@@ -0,0 +1,46 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryStore пази кофите в паметта на процеса. Подходящ е при една инстанция.
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*bucket)}
+}
+
+const memoryCleanupSize = 10000
+
+func (s *MemoryStore) Take(key string, rate, burst float64, now time.Time) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.buckets) >= memoryCleanupSize {
+		s.cleanup(rate, burst, now)
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, updatedAt: now}
+		s.buckets[key] = b
+	}
+
+	allowed, wait := b.take(rate, burst, now)
+	return allowed, wait, nil
+}
+
+// cleanup премахва кофите, които вече биха били пълни.
+func (s *MemoryStore) cleanup(rate, burst float64, now time.Time) {
+	refill := time.Duration(burst / rate * float64(time.Second))
+	for key, b := range s.buckets {
+		if now.Sub(b.updatedAt) >= refill {
+			delete(s.buckets, key)
+		}
+	}
+}
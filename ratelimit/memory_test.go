@@ -0,0 +1,63 @@
+package ratelimit
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreTake(t *testing.T) {
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+
+	// 1 токен в секунда, до 3 натрупани
+	steps := []struct {
+		name    string
+		key     string
+		now     time.Time
+		allowed bool
+		wait    time.Duration
+	}{
+		{"full bucket", "a", at(0), true, 0},
+		{"full bucket", "a", at(0), true, 0},
+		{"last token", "a", at(0), true, 0},
+		{"empty bucket", "a", at(0), false, time.Second},
+		{"other key has its own bucket", "b", at(0), true, 0},
+		{"partly refilled", "a", at(500 * time.Millisecond), false, 500 * time.Millisecond},
+		{"one token refilled", "a", at(time.Second), true, 0},
+		{"empty again", "a", at(time.Second), false, time.Second},
+		{"refill is capped at burst", "a", at(time.Minute), true, 0},
+		{"refill is capped at burst", "a", at(time.Minute), true, 0},
+		{"refill is capped at burst", "a", at(time.Minute), true, 0},
+		{"refill is capped at burst", "a", at(time.Minute), false, time.Second},
+	}
+
+	store := NewMemoryStore()
+	for i, step := range steps {
+		allowed, wait, err := store.Take(step.key, 1, 3, step.now)
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if allowed != step.allowed || wait != step.wait {
+			t.Errorf("step %d (%s): got (%v, %s), want (%v, %s)", i, step.name, allowed, wait, step.allowed, step.wait)
+		}
+	}
+}
+
+func TestMemoryStoreCleanup(t *testing.T) {
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	store := NewMemoryStore()
+	for i := 0; i < memoryCleanupSize; i++ {
+		store.Take(fmt.Sprintf("key-%d", i), 1, 3, start)
+	}
+	store.Take("recent", 1, 3, start.Add(2*time.Second))
+
+	// Кофите се пълнят за 3 секунди - след тях старите се изтриват, а новата остава
+	store.Take("trigger", 1, 3, start.Add(3*time.Second))
+	if len(store.buckets) != 2 {
+		t.Errorf("%d buckets after cleanup, want 2", len(store.buckets))
+	}
+	if _, ok := store.buckets["recent"]; !ok {
+		t.Error("bucket that is not yet full was removed")
+	}
+}
@@ -0,0 +1,54 @@
+package ratelimit
+
+import (
+	"database/sql"
+	"time"
+)
+
+// MySQLStore пази кофите в таблицата rate_limits, за да се споделят
+// между няколко инстанции на приложението.
+type MySQLStore struct {
+	db *sql.DB
+}
+
+func NewMySQLStore(db *sql.DB) *MySQLStore {
+	return &MySQLStore{db: db}
+}
+
+func (s *MySQLStore) Take(key string, rate, burst float64, now time.Time) (bool, time.Duration, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, 0, err
+	}
+	defer tx.Rollback()
+
+	b := bucket{tokens: burst, updatedAt: now}
+	var updatedAt int64
+	err = tx.QueryRow(`
+        SELECT tokens, updated_at
+        FROM rate_limits
+        WHERE bucket_key = ?
+        FOR UPDATE`, key).Scan(&b.tokens, &updatedAt)
+	switch {
+	case err == nil:
+		b.updatedAt = time.UnixMicro(updatedAt)
+	case err != sql.ErrNoRows:
+		return false, 0, err
+	}
+
+	allowed, wait := b.take(rate, burst, now)
+
+	_, err = tx.Exec(`
+        INSERT INTO rate_limits (bucket_key, tokens, updated_at)
+        VALUES (?, ?, ?)
+        ON DUPLICATE KEY UPDATE tokens = VALUES(tokens), updated_at = VALUES(updated_at)`,
+		key, b.tokens, b.updatedAt.UnixMicro())
+	if err != nil {
+		return false, 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, 0, err
+	}
+	return allowed, wait, nil
+}
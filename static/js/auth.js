@@ -3,6 +3,7 @@ async function register() {
     const username = document.getElementById('registerUsername').value;
     const password = document.getElementById('registerPassword').value;
     const height = parseFloat(document.getElementById('registerHeight').value);
+    const timezone = Intl.DateTimeFormat().resolvedOptions().timeZone;
 
     try {
         const response = await fetch(`${config.apiUrl}${config.endpoints.register}`, {
@@ -10,7 +11,7 @@ async function register() {
             headers: {
                 'Content-Type': 'application/json',
             },
-            body: JSON.stringify({ username, password, height })
+            body: JSON.stringify({ username, password, height, timezone })
         });
 
         if (response.ok) {
@@ -18,7 +19,7 @@ async function register() {
             loadComponent('auth');
         } else {
             const data = await response.json();
-            alert(data.error || 'Грешка при регистрация');
+            alert(formatApiError(data, 'Грешка при регистрация'));
         }
     } catch (error) {
         console.error('Error:', error);
@@ -41,8 +42,14 @@ async function login() {
         });
 
         if (response.ok) {
-            const data = await response.json();
-            localStorage.setItem('token', data.token);
+            let data = await response.json();
+            if (data.twoFactorRequired) {
+                data = await completeTwoFactorLogin(data.challengeToken);
+                if (!data) {
+                    return;
+                }
+            }
+            saveSession(data);
             localStorage.setItem('user', JSON.stringify(data.user));
             document.getElementById('mainNav').style.display = 'flex';
             showStats();
@@ -56,13 +63,143 @@ async function login() {
     }
 }
 
-function logout() {
+function loginWithOidc() {
+    window.location.href = `${config.apiUrl}${config.endpoints.oidcLogin}`;
+}
+
+// След вход през OIDC сървърът пренасочва обратно с токените във фрагмента на адреса
+async function handleOidcRedirect() {
+    const params = new URLSearchParams(window.location.hash.substring(1));
+    if (!params.has('userId')) {
+        return false;
+    }
+    window.history.replaceState(null, '', '/');
+
+    let data = {
+        token: params.get('token'),
+        expiresAt: params.get('expiresAt'),
+        refreshToken: params.get('refreshToken')
+    };
+    if (params.has('challengeToken')) {
+        data = await completeTwoFactorLogin(params.get('challengeToken'));
+        if (!data) {
+            return false;
+        }
+    }
+
+    saveSession(data);
+    localStorage.setItem('user', JSON.stringify(data.user || {
+        id: parseInt(params.get('userId')),
+        username: params.get('username')
+    }));
+    document.getElementById('mainNav').style.display = 'flex';
+    showStats();
+    return true;
+}
+
+// Втора стъпка от входа при включена двуфакторна автентикация
+async function completeTwoFactorLogin(challengeToken) {
+    const input = prompt('Въведете кода от приложението за удостоверяване или резервен код:');
+    if (!input) {
+        return null;
+    }
+
+    const code = input.trim();
+    const body = /^\d{6}$/.test(code)
+        ? { challengeToken, code }
+        : { challengeToken, recoveryCode: code };
+
+    const response = await fetch(`${config.apiUrl}${config.endpoints.loginTwoFactor}`, {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json',
+        },
+        body: JSON.stringify(body)
+    });
+
+    const data = await response.json();
+    if (!response.ok) {
+        alert(data.error || 'Невалиден код');
+        return null;
+    }
+    return data;
+}
+
+async function logout() {
+    try {
+        await fetch(`${config.apiUrl}${config.endpoints.logout}`, {
+            method: 'POST',
+            headers: getAuthHeaders()
+        });
+    } catch (error) {
+        console.error('Error:', error);
+    }
+    clearSession();
+}
+
+function clearSession() {
+    clearTimeout(refreshTimer);
     localStorage.removeItem('token');
+    localStorage.removeItem('refreshToken');
+    localStorage.removeItem('tokenExpiresAt');
     localStorage.removeItem('user');
+    // Кешираните от service worker-а отговори са на този потребител
+    if ('caches' in window) {
+        caches.delete('weight-challenge-api-v2');
+    }
+    if (navigator.serviceWorker && navigator.serviceWorker.controller) {
+        navigator.serviceWorker.controller.postMessage({ type: 'logout' });
+    }
     document.getElementById('mainNav').style.display = 'none';
     loadComponent('auth');
 }
 
+// Управление на сесията
+let refreshTimer = null;
+
+function saveSession(data) {
+    localStorage.setItem('token', data.token);
+    localStorage.setItem('refreshToken', data.refreshToken);
+    localStorage.setItem('tokenExpiresAt', data.expiresAt);
+    scheduleTokenRefresh();
+}
+
+// Подновяваме токена минута преди да изтече
+function scheduleTokenRefresh() {
+    clearTimeout(refreshTimer);
+    const expiresAt = new Date(localStorage.getItem('tokenExpiresAt')).getTime();
+    const delay = Math.max(expiresAt - Date.now() - 60000, 0);
+    refreshTimer = setTimeout(refreshSession, delay || 0);
+}
+
+async function refreshSession() {
+    const refreshToken = localStorage.getItem('refreshToken');
+    if (!refreshToken) {
+        clearSession();
+        return;
+    }
+
+    try {
+        const response = await fetch(`${config.apiUrl}${config.endpoints.tokenRefresh}`, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+            },
+            body: JSON.stringify({ refreshToken })
+        });
+
+        if (response.ok) {
+            saveSession(await response.json());
+        } else {
+            clearSession();
+        }
+    } catch (error) {
+        // При липса на връзка опитваме отново по-късно
+        console.error('Error:', error);
+        refreshTimer = setTimeout(refreshSession, 30000);
+    }
+}
+
 async function resetPassword() {
     const username = document.getElementById('resetUsername').value;
     
@@ -81,8 +218,7 @@ async function resetPassword() {
         });
 
         if (response.ok) {
-            const data = await response.json();
-            alert(`Вашата нова парола е: ${data.newPassword}\nМоля, запомнете я и я променете след вход в системата.`);
+            alert('Ако акаунтът съществува, на имейла му е изпратен линк за смяна на паролата.');
             loadComponent('auth');
         } else {
             const data = await response.json();
@@ -94,6 +230,46 @@ async function resetPassword() {
     }
 }
 
+async function confirmPasswordReset() {
+    const token = new URLSearchParams(window.location.search).get('resetToken');
+    const newPassword = document.getElementById('resetNewPassword').value;
+
+    if (!token || !newPassword) {
+        alert('Моля, въведете нова парола');
+        return;
+    }
+
+    try {
+        const response = await fetch(`${config.apiUrl}${config.endpoints.resetPasswordConfirm}`, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+            },
+            body: JSON.stringify({ token, newPassword })
+        });
+
+        if (response.ok) {
+            alert('Паролата е променена успешно. Моля, влезте в системата.');
+            window.history.replaceState(null, '', '/');
+            await loadComponent('auth');
+            showLoginForm();
+        } else {
+            const data = await response.json();
+            alert(formatApiError(data, 'Грешка при смяна на паролата'));
+        }
+    } catch (error) {
+        console.error('Error:', error);
+        alert('Възникна грешка при комуникацията със сървъра');
+    }
+}
+
+function showResetPasswordConfirm() {
+    document.getElementById('registerForm').style.display = 'none';
+    document.getElementById('loginForm').style.display = 'none';
+    document.getElementById('resetPasswordForm').style.display = 'none';
+    document.getElementById('resetPasswordConfirmForm').style.display = 'block';
+}
+
 // Помощни функции
 function showLogin() {
     document.getElementById('registerForm').style.display = 'none';
@@ -4,12 +4,24 @@ const config = {
     endpoints: {
         register: '/register',
         login: '/login',
+        loginTwoFactor: '/login/2fa',
+        oidcLogin: '/auth/oidc/login',
         resetPassword: '/reset-password',
+        resetPasswordConfirm: '/reset-password/confirm',
+        tokenRefresh: '/token/refresh',
+        logout: '/logout',
+        logoutAll: '/logout-all',
         weight: '/weight',
         weightStats: '/weight/stats',
+        weightHistory: '/weight/history',
+        weightProjection: '/weight/projection',
+        weightAggregate: '/weight/aggregate',
         weightDelete: '/weight/:id',
+        sync: '/sync',
         userSettings: '/user/settings',
         changePassword: '/user/password',
+        userExport: '/user/export',
+        deleteAccount: '/user',
         users: '/users',
         visibility: '/user/visibility',
         friends: '/friends',
@@ -23,9 +23,13 @@ async function saveSettings() {
         lastName: document.getElementById('lastName').value,
         email: document.getElementById('email').value,
         age: parseInt(document.getElementById('age').value),
-        height: parseInt(document.getElementById('height').value),
+        height: parseFloat(document.getElementById('height').value),
+        heightUnit: document.getElementById('heightUnit').value,
         gender: document.getElementById('gender').value,
         targetWeight: parseFloat(document.getElementById('targetWeight').value),
+        weightUnit: document.getElementById('weightUnit').value,
+        timezone: document.getElementById('timezone').value.trim(),
+        dailyPolicy: document.getElementById('dailyPolicy').value,
         isVisible: document.getElementById('isVisible').checked
     };
 
@@ -75,12 +79,73 @@ async function changePassword() {
         });
 
         if (response.ok) {
+            // Сървърът прекратява всички сесии и връща нова за това устройство
+            saveSession(await response.json());
             alert('Паролата е променена успешно');
             document.getElementById('currentPassword').value = '';
             document.getElementById('newPassword').value = '';
         } else {
             const data = await response.json();
-            alert(data.error || 'Грешка при промяна на паролата');
+            alert(formatApiError(data, 'Грешка при промяна на паролата'));
+        }
+    } catch (error) {
+        console.error('Error:', error);
+        alert('Грешка при комуникацията със сървъра');
+    }
+}
+
+async function exportUserData() {
+    try {
+        const response = await fetch(`${config.apiUrl}${config.endpoints.userExport}?format=zip`, {
+            headers: getAuthHeaders()
+        });
+
+        if (!response.ok) {
+            const data = await response.json();
+            alert(data.error || 'Грешка при експорт на данните');
+            return;
+        }
+
+        const url = URL.createObjectURL(await response.blob());
+        const link = document.createElement('a');
+        link.href = url;
+        link.download = 'weight-challenge-export.zip';
+        link.click();
+        URL.revokeObjectURL(url);
+    } catch (error) {
+        console.error('Error:', error);
+        alert('Грешка при комуникацията със сървъра');
+    }
+}
+
+async function deleteAccount() {
+    // Акаунтите, създадени през външен доставчик, потвърждават с 2FA код или скорошен вход
+    const password = prompt('Изтриването е окончателно. Въведете паролата си за потвърждение (при вход през външен доставчик оставете празно):');
+    if (password === null) {
+        return;
+    }
+    const body = { password };
+    if (!password) {
+        const code = prompt('Въведете кода за двуфакторна автентикация, ако сте я включили:');
+        if (code === null) {
+            return;
+        }
+        body.code = code;
+    }
+
+    try {
+        const response = await fetch(`${config.apiUrl}${config.endpoints.deleteAccount}`, {
+            method: 'DELETE',
+            headers: getAuthHeaders(),
+            body: JSON.stringify(body)
+        });
+
+        if (response.ok) {
+            alert('Акаунтът е изтрит');
+            clearSession();
+        } else {
+            const data = await response.json();
+            alert(data.error || 'Грешка при изтриване на акаунта');
         }
     } catch (error) {
         console.error('Error:', error);
@@ -94,9 +159,13 @@ function updateSettingsForm(data) {
     document.getElementById('lastName').value = data.lastName || '';
     document.getElementById('email').value = data.email || '';
     document.getElementById('age').value = data.age || '';
-    document.getElementById('height').value = data.height || '';
+    document.getElementById('height').value = data.height ? parseFloat(data.height.toFixed(1)) : '';
+    document.getElementById('heightUnit').value = data.heightUnit || 'cm';
     document.getElementById('gender').value = data.gender || '';
-    document.getElementById('targetWeight').value = data.targetWeight || '';
+    document.getElementById('targetWeight').value = data.targetWeight ? parseFloat(data.targetWeight.toFixed(1)) : '';
+    document.getElementById('weightUnit').value = data.weightUnit || 'kg';
+    document.getElementById('timezone').value = data.timezone || Intl.DateTimeFormat().resolvedOptions().timeZone;
+    document.getElementById('dailyPolicy').value = data.dailyPolicy || 'last';
     document.getElementById('isVisible').checked = data.isVisible;
 }
 
@@ -567,9 +567,9 @@ function displayChallengeResults(challenge) {
                     challenge.results.map(result => `
                         <div class="result-card">
                             <strong>${result.username}</strong>
-                            <p>Начално тегло: ${result.initialWeight.toFixed(1)} кг</p>
+                            <p>Начално тегло: ${result.initialWeight.toFixed(1)} ${unitLabel(result.weightUnit)}</p>
                             ${result.finalWeight ? `
-                                <p>Крайно тегло: ${result.finalWeight.toFixed(1)} кг</p>
+                                <p>Крайно тегло: ${result.finalWeight.toFixed(1)} ${unitLabel(result.weightUnit)}</p>
                                 <p>Прогрес: ${result.progress.toFixed(2)}%</p>
                             ` : '<p>Все още няма краен резултат</p>'}
                         </div>
@@ -38,6 +38,15 @@ function showError(message) {
     alert(message || 'Възникна грешка');
 }
 
+// Съобщение за грешка от API-то, включително нарушените правила за паролата
+function formatApiError(data, fallback) {
+    const message = data.error || fallback;
+    if (!data.violations) {
+        return message;
+    }
+    return [message, ...data.violations.map(v => `- ${v.message}`)].join('\n');
+}
+
 function showSuccess(message) {
     alert(message || 'Операцията е успешна');
 }
@@ -56,4 +65,10 @@ function isAuthenticated() {
 function getCurrentUser() {
     const userJson = localStorage.getItem('user');
     return userJson ? JSON.parse(userJson) : null;
-} 
\ No newline at end of file
+} 
+
+// Кратко означение на мерна единица, както идва от сървъра
+function unitLabel(unit) {
+    const labels = { kg: 'кг', lb: 'lb', st: 'st', cm: 'см', ftin: 'in' };
+    return labels[unit] || 'кг';
+}
@@ -8,24 +8,41 @@ async function addWeight() {
         return;
     }
 
+    // Един ключ за записа, така че повторно изпращане не създава дубликат
+    const form = document.getElementById('weightForm');
+    form.dataset.idempotencyKey = form.dataset.idempotencyKey || crypto.randomUUID();
+
     try {
         const response = await fetch(`${config.apiUrl}${config.endpoints.weight}`, {
             method: 'POST',
             headers: {
                 'Content-Type': 'application/json',
-                'Authorization': localStorage.getItem('token')
+                'Authorization': localStorage.getItem('token'),
+                'Idempotency-Key': form.dataset.idempotencyKey
             },
             body: JSON.stringify({
                 weight,
-                createdAt: new Date(weightDate).toISOString()
+                createdAt: new Date(weightDate).toISOString(),
+                measurements: readMeasurements()
             })
         });
 
         if (response.ok) {
+            const record = await response.json();
+            if (record.queued) {
+                alert('Няма връзка със сървъра - записът ще бъде изпратен автоматично');
+            } else if (record.isOutlier) {
+                alert('Теглото се различава рязко от досегашния тренд и няма да участва в статистиката, докато не го потвърдите');
+            }
+            delete form.dataset.idempotencyKey;
             document.getElementById('weight').value = '';
             document.getElementById('weightDate').value = '';
+            document.getElementById('bodyFatPercent').value = '';
+            document.getElementById('waist').value = '';
             await showStats();
         } else {
+            // Сървърът е отговорил - следващият опит е нова заявка
+            delete form.dataset.idempotencyKey;
             const data = await response.json();
             alert(data.error || 'Грешка при запазване на теглото');
         }
@@ -35,6 +52,44 @@ async function addWeight() {
     }
 }
 
+// Незадължителните измервания се изпращат само ако са попълнени
+function readMeasurements() {
+    const bodyFatPercent = parseFloat(document.getElementById('bodyFatPercent').value);
+    const waist = parseFloat(document.getElementById('waist').value);
+    const measurements = {};
+    if (bodyFatPercent) {
+        measurements.bodyFatPercent = bodyFatPercent;
+    }
+    if (waist) {
+        measurements.waist = waist;
+    }
+    return Object.keys(measurements).length ? measurements : undefined;
+}
+
+// Потвърждава запис, отбелязан като рязко отклонение
+async function confirmWeight(weightId) {
+    try {
+        const response = await fetch(`${config.apiUrl}${config.endpoints.weightDelete.replace(':id', weightId)}`, {
+            method: 'PATCH',
+            headers: {
+                'Content-Type': 'application/json',
+                'Authorization': localStorage.getItem('token')
+            },
+            body: JSON.stringify({ confirm: true })
+        });
+
+        if (response.ok) {
+            await loadStats();
+        } else {
+            const data = await response.json();
+            alert(data.error || 'Грешка при потвърждаване на теглото');
+        }
+    } catch (error) {
+        console.error('Error:', error);
+        alert('Възникна грешка при комуникацията със сървъра');
+    }
+}
+
 async function deleteWeight(weightId) {
     // Проверяваме дали имаме валидно ID
     if (!weightId) {
@@ -97,9 +152,25 @@ function updateStatsDisplay(data) {
     document.getElementById('initialWeight').textContent = data.initialWeight ? data.initialWeight.toFixed(1) : '-';
     document.getElementById('totalProgress').textContent = data.totalProgress ? data.totalProgress.toFixed(2) : '-';
     document.getElementById('dailyProgress').textContent = data.dailyProgress ? data.dailyProgress.toFixed(2) : '-';
+    document.getElementById('trendWeight').textContent = data.trendWeight ? data.trendWeight.toFixed(1) : '-';
+    document.getElementById('trendProgress').textContent = data.trendProgress ? data.trendProgress.toFixed(2) : '-';
+    document.getElementById('goalProjection').textContent = formatProjection(data.projection);
     document.getElementById('bmi').textContent = data.bmi ? data.bmi.toFixed(1) : '-';
 }
 
+function formatProjection(projection) {
+    if (!projection) {
+        return '-';
+    }
+    if (projection.reached) {
+        return 'Целта е достигната';
+    }
+    if (!projection.projectedDate) {
+        return 'Не се достига с текущото темпо';
+    }
+    return new Date(projection.projectedDate).toLocaleDateString('bg-BG');
+}
+
 function updateHistoryDisplay(history) {
     const historyContainer = document.getElementById('weightHistory');
     if (!historyContainer) return;
@@ -131,7 +202,8 @@ function updateHistoryDisplay(history) {
         historyContainer.innerHTML += `
             <div class="history-item" data-id="${recordId}">
                 <div>
-                    <strong>${weight} кг</strong>
+                    <strong>${weight} ${unitLabel(record.unit)}</strong>
+                    ${record.isOutlier ? `<button onclick="confirmWeight(${recordId})">Потвърди</button>` : ''}
                     <span>${date}</span>
                 </div>
                 <button class="delete-button" onclick="deleteWeight(${recordId})">
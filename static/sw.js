@@ -1,27 +1,253 @@
-const CACHE_NAME = 'weight-challenge-v1';
+const CACHE_NAME = 'weight-challenge-v3';
+const API_CACHE_NAME = 'weight-challenge-api-v2';
 const urlsToCache = [
     '/',
     '/static/index.html',
     '/static/manifest.json',
-    '/static/icon-192x192.png',
-    '/static/icon-512x512.png'
+    '/static/css/styles.css',
+    '/static/js/config.js',
+    '/static/js/utils.js',
+    '/static/js/auth.js',
+    '/static/js/weight.js',
+    '/static/js/social.js',
+    '/static/js/settings.js'
 ];
 
+// Промените по теглото без връзка се пазят в IndexedDB и се изпращат към POST /sync
+const QUEUE_DB = 'weight-challenge-sync';
+const QUEUE_STORE = 'changes';
+const SYNC_TAG = 'weight-sync';
+// Същото ограничение като models.MaxSyncBatch на сървъра
+const MAX_SYNC_BATCH = 500;
+
+// Само данните за основния екран се пазят за офлайн режим; останалите отговори
+// (настройки, износ на данни) не се записват на устройството
+const OFFLINE_API_PATHS = ['/weight/stats', '/friends', '/challenges'];
+
 self.addEventListener('install', event => {
     event.waitUntil(
         caches.open(CACHE_NAME)
             .then(cache => cache.addAll(urlsToCache))
+            .then(() => self.skipWaiting())
     );
 });
 
-self.addEventListener('fetch', event => {
-    event.respondWith(
-        caches.match(event.request)
-            .then(response => {
-                if (response) {
-                    return response;
-                }
-                return fetch(event.request);
-            })
+self.addEventListener('activate', event => {
+    event.waitUntil(
+        caches.keys()
+            .then(keys => Promise.all(keys
+                .filter(key => key !== CACHE_NAME && key !== API_CACHE_NAME)
+                .map(key => caches.delete(key))))
+            .then(() => self.clients.claim())
     );
-}); 
\ No newline at end of file
+});
+
+self.addEventListener('fetch', event => {
+    const request = event.request;
+    const url = new URL(request.url);
+
+    if (url.origin === self.location.origin && (url.pathname === '/' || url.pathname === '/sw.js' || url.pathname.startsWith('/static/'))) {
+        event.respondWith(
+            caches.match(request).then(response => response || fetch(request))
+        );
+        return;
+    }
+
+    if (request.method === 'GET' && OFFLINE_API_PATHS.includes(url.pathname)) {
+        event.respondWith(networkFirst(request));
+        return;
+    }
+
+    if (isWeightChange(request, url)) {
+        event.respondWith(fetchOrQueue(request, url));
+    }
+});
+
+self.addEventListener('sync', event => {
+    if (event.tag === SYNC_TAG) {
+        event.waitUntil(requestToken().then(token => token && flushQueue(token)));
+    }
+});
+
+// Страницата изпраща {type: 'flush', token}, когато връзката се възстанови (за браузъри без
+// Background Sync), и {type: 'logout'}, за да изтрие кешираните данни на потребителя
+self.addEventListener('message', event => {
+    if (!event.data) {
+        return;
+    }
+    if (event.data.type === 'flush' && event.data.token) {
+        event.waitUntil(flushQueue(event.data.token));
+    }
+    if (event.data.type === 'logout') {
+        event.waitUntil(caches.delete(API_CACHE_NAME));
+    }
+});
+
+// requestToken взима текущия токен от отворена страница - токенът от момента на
+// записването в опашката обикновено е изтекъл. Без отворена страница връща null.
+async function requestToken() {
+    const clients = await self.clients.matchAll({ type: 'window' });
+    for (const client of clients) {
+        const token = await new Promise(resolve => {
+            const channel = new MessageChannel();
+            const timer = setTimeout(() => resolve(null), 5000);
+            channel.port1.onmessage = event => {
+                clearTimeout(timer);
+                resolve(event.data && event.data.token);
+            };
+            client.postMessage({ type: 'token-request' }, [channel.port2]);
+        });
+        if (token) {
+            return token;
+        }
+    }
+    return null;
+}
+
+// tokenUserId чете потребителя от токена, за да не се изпратят промените на един
+// потребител от името на друг, влязъл по-късно на същото устройство
+function tokenUserId(token) {
+    try {
+        const payload = token.replace(/^Bearer /, '').split('.')[1];
+        return JSON.parse(atob(payload.replace(/-/g, '+').replace(/_/g, '/'))).uid;
+    } catch (error) {
+        return null;
+    }
+}
+
+// API заявките за четене отиват към сървъра, а при липса на връзка се връща последният отговор
+async function networkFirst(request) {
+    const cache = await caches.open(API_CACHE_NAME);
+    try {
+        const response = await fetch(request);
+        if (response.ok) {
+            cache.put(request, response.clone());
+        }
+        return response;
+    } catch (error) {
+        const cached = await cache.match(request);
+        if (cached) {
+            return cached;
+        }
+        throw error;
+    }
+}
+
+function isWeightChange(request, url) {
+    if (request.method === 'POST') {
+        return url.pathname === '/weight';
+    }
+    return (request.method === 'PATCH' || request.method === 'DELETE') && /^\/weight\/\d+$/.test(url.pathname);
+}
+
+async function fetchOrQueue(request, url) {
+    const body = request.method === 'DELETE' ? null : await request.clone().json();
+    try {
+        return await fetch(request);
+    } catch (error) {
+        await enqueue(toSyncChange(request, url, body), tokenUserId(request.headers.get('Authorization') || ''), url.origin);
+        if (self.registration.sync) {
+            await self.registration.sync.register(SYNC_TAG).catch(() => {});
+        }
+        return new Response(JSON.stringify({ queued: true }), {
+            status: 202,
+            headers: { 'Content-Type': 'application/json' }
+        });
+    }
+}
+
+function toSyncChange(request, url, body) {
+    if (request.method === 'POST') {
+        return { ...body, action: 'create', clientId: crypto.randomUUID() };
+    }
+    const id = parseInt(url.pathname.split('/').pop(), 10);
+    if (request.method === 'DELETE') {
+        return { action: 'delete', id };
+    }
+    return { ...body, action: 'update', id };
+}
+
+async function flushQueue(token) {
+    const userId = tokenUserId(token);
+    // Записите от по-старата версия пазят целия токен вместо потребителя
+    const entries = (await readQueue())
+        .filter(entry => (entry.userId ?? tokenUserId(entry.authorization || '')) === userId);
+    if (!entries.length) {
+        return;
+    }
+
+    // Заявките се групират по адрес и се изпращат на части до MAX_SYNC_BATCH промени
+    const groups = new Map();
+    for (const entry of entries) {
+        if (!groups.has(entry.origin)) {
+            groups.set(entry.origin, []);
+        }
+        groups.get(entry.origin).push(entry);
+    }
+
+    for (const [origin, group] of groups) {
+        for (let i = 0; i < group.length; i += MAX_SYNC_BATCH) {
+            const batch = group.slice(i, i + MAX_SYNC_BATCH);
+            const response = await fetch(`${origin}/sync`, {
+                method: 'POST',
+                headers: {
+                    'Content-Type': 'application/json',
+                    'Authorization': token
+                },
+                body: JSON.stringify({ weightRecords: batch.map(entry => entry.change) })
+            });
+
+            // При изтекъл токен или грешка на сървъра промените остават за следващия опит.
+            // 400 означава невалидна заявка, която няма да мине и при повторение -
+            // грешките в отделните промени идват като rejected в успешния отговор.
+            if (!response.ok && response.status !== 400) {
+                break;
+            }
+            await removeFromQueue(batch.map(entry => entry.id));
+        }
+    }
+
+    const clients = await self.clients.matchAll();
+    clients.forEach(client => client.postMessage({ type: 'synced' }));
+}
+
+function openQueue() {
+    return new Promise((resolve, reject) => {
+        const request = indexedDB.open(QUEUE_DB, 1);
+        request.onupgradeneeded = () => {
+            request.result.createObjectStore(QUEUE_STORE, { keyPath: 'id', autoIncrement: true });
+        };
+        request.onsuccess = () => resolve(request.result);
+        request.onerror = () => reject(request.error);
+    });
+}
+
+async function enqueue(change, userId, origin) {
+    const db = await openQueue();
+    return new Promise((resolve, reject) => {
+        const tx = db.transaction(QUEUE_STORE, 'readwrite');
+        tx.objectStore(QUEUE_STORE).add({ change, userId, origin });
+        tx.oncomplete = () => resolve();
+        tx.onerror = () => reject(tx.error);
+    });
+}
+
+async function readQueue() {
+    const db = await openQueue();
+    return new Promise((resolve, reject) => {
+        const request = db.transaction(QUEUE_STORE).objectStore(QUEUE_STORE).getAll();
+        request.onsuccess = () => resolve(request.result);
+        request.onerror = () => reject(request.error);
+    });
+}
+
+async function removeFromQueue(ids) {
+    const db = await openQueue();
+    return new Promise((resolve, reject) => {
+        const tx = db.transaction(QUEUE_STORE, 'readwrite');
+        const store = tx.objectStore(QUEUE_STORE);
+        ids.forEach(id => store.delete(id));
+        tx.oncomplete = () => resolve();
+        tx.onerror = () => reject(tx.error);
+    });
+}